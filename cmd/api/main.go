@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 
 	"p2p-chess/internal/auth"
+	"p2p-chess/internal/certificate"
 	apihttp "p2p-chess/internal/http"
+	"p2p-chess/internal/lobby"
+	"p2p-chess/internal/matchkey"
+	"p2p-chess/internal/referee"
+	"p2p-chess/internal/signaling"
 	"p2p-chess/internal/store"
 
 	"github.com/joho/godotenv"
@@ -29,8 +35,22 @@ func main() {
 	if err := auth.Init(); err != nil {
 		log.Fatal("Auth initialization error: ", err)
 	}
+	if err := matchkey.Init(); err != nil {
+		log.Fatal("Match key initialization error: ", err)
+	}
+	if err := certificate.Init(); err != nil {
+		log.Fatal("Certificate initialization error: ", err)
+	}
+
+	s, err := store.New()
+	if err != nil {
+		log.Fatal("Store initialization error: ", err)
+	}
+
+	go referee.RunFlagWatchdog(context.Background(), s)
+	go lobby.RunPairing(context.Background(), s)
 
-	router := apihttp.NewRouter()
+	router := apihttp.NewRouter(s, signaling.NewHub(s))
 	log.Println("Server starting on :8081")
 	log.Fatal(http.ListenAndServe(":8081", router))
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"p2p-chess/internal/matchkey"
+	"p2p-chess/internal/referee"
+	"p2p-chess/internal/store"
+
+	"github.com/joho/godotenv"
+)
+
+// verify replays match logs and reports tampering.
+//
+//	verify -match <id>   check one match
+//	verify -sweep [-all] check finished matches not yet verified (or all)
+//
+// Add -flag to record the verdicts on the matches table; a sweep always does.
+func main() {
+	matchID := flag.String("match", "", "match ID to verify")
+	sweep := flag.Bool("sweep", false, "verify finished matches")
+	all := flag.Bool("all", false, "with -sweep, re-verify matches already checked")
+	record := flag.Bool("flag", false, "with -match, record the verdict in the database")
+	flag.Parse()
+	if (*matchID == "") == !*sweep {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file, using environment")
+	}
+	if err := matchkey.Init(); err != nil {
+		log.Fatal("Match key initialization error: ", err)
+	}
+	s, err := store.New()
+	if err != nil {
+		log.Fatal("Store initialization error: ", err)
+	}
+	ctx := context.Background()
+
+	var reports []*referee.ReplayReport
+	if *sweep {
+		reports, err = referee.VerifyFinished(ctx, s, *all)
+	} else {
+		var rep *referee.ReplayReport
+		rep, err = referee.ReplayMatch(ctx, s.DB, *matchID)
+		if err == nil && *record {
+			err = referee.RecordVerification(ctx, s.DB, rep)
+		}
+		if rep != nil {
+			reports = append(reports, rep)
+		}
+	}
+
+	bad := 0
+	for _, rep := range reports {
+		if rep.OK() {
+			fmt.Printf("%s ok (%d events)\n", rep.MatchID, rep.Events)
+			continue
+		}
+		bad++
+		fmt.Printf("%s SUSPICIOUS %s\n", rep.MatchID, rep.Issue)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if bad > 0 {
+		os.Exit(1)
+	}
+}
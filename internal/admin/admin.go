@@ -1,10 +1,14 @@
 package admin
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
+	"p2p-chess/internal/auth"
+	"p2p-chess/internal/referee"
 	"p2p-chess/internal/store"
 
-	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/v5"
 )
 
 func AdminBanHandler(w http.ResponseWriter, r *http.Request) {
@@ -30,4 +34,109 @@ func AdminAbortHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// AdminVerifyHandler replays one match, flags it when the log does not hold
+// up and returns the report.
+func AdminVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	matchID := chi.URLParam(r, "matchID")
+	s, _ := store.New()
+	rep, err := referee.ReplayMatch(r.Context(), s.DB, matchID)
+	if errors.Is(err, referee.ErrMatchNotFound) {
+		http.Error(w, "Match not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = referee.RecordVerification(r.Context(), s.DB, rep)
+	}
+	if err != nil {
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
+
+// AdminSweepHandler verifies finished matches not yet checked (all of them
+// with ?all=1) and returns the ones flagged as suspicious.
+func AdminSweepHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := store.New()
+	reports, err := referee.VerifyFinished(r.Context(), s, r.URL.Query().Get("all") == "1")
+	if err != nil {
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	suspicious := []*referee.ReplayReport{}
+	for _, rep := range reports {
+		if !rep.OK() {
+			suspicious = append(suspicious, rep)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"verified": len(reports), "suspicious": suspicious})
+}
+
+// AdminDisputesHandler lists disputes, optionally filtered by ?status=.
+func AdminDisputesHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := store.New()
+	disputes, err := referee.ListDisputes(r.Context(), s.DB, r.URL.Query().Get("status"), 100)
+	if err != nil {
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(disputes)
+}
+
+// AdminDisputeHandler returns one dispute with both players' logs.
+func AdminDisputeHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := store.New()
+	d, err := referee.LoadDispute(r.Context(), s.DB, chi.URLParam(r, "disputeID"))
+	if errors.Is(err, referee.ErrDisputeNotFound) {
+		http.Error(w, "Dispute not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+type OverrideRequest struct {
+	Result string `json:"result"`
+	Reason string `json:"reason"`
+}
+
+// AdminOverrideDisputeHandler replaces the referee's ruling with the
+// admin's result. It runs behind AdminMiddleware, which leaves the admin's
+// token in the request context.
+func AdminOverrideDisputeHandler(w http.ResponseWriter, r *http.Request) {
+	tok, ok := auth.TokenFromContext(r.Context())
+	if !ok || tok.Subject() == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	adminID := tok.Subject()
+	var req OverrideRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	s, _ := store.New()
+	d, err := referee.OverrideDispute(r.Context(), s, chi.URLParam(r, "disputeID"), adminID, req.Result, req.Reason)
+	switch {
+	case errors.Is(err, referee.ErrDisputeNotFound):
+		http.Error(w, "Dispute not found", http.StatusNotFound)
+		return
+	case errors.Is(err, referee.ErrBadResult):
+		http.Error(w, "Invalid result", http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
 // More admin functions
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"log"
@@ -61,6 +62,43 @@ func ValidateToken(tokenStr string) (jwt.Token, error) {
 	return jwt.Parse([]byte(tokenStr), jwt.WithKey(jwa.HS256, hmacKey), jwt.WithValidate(true))
 }
 
+var ErrNoBearer = errors.New("no bearer")
+
+// TokenFromRequest validates the bearer token on r.
+func TokenFromRequest(r *http.Request) (jwt.Token, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, ErrNoBearer
+	}
+	return ValidateToken(strings.TrimPrefix(h, "Bearer "))
+}
+
+// UserIDFromRequest returns the subject of the bearer token on r.
+func UserIDFromRequest(r *http.Request) (string, error) {
+	tok, err := TokenFromRequest(r)
+	if err != nil {
+		return "", err
+	}
+	if tok.Subject() == "" {
+		return "", errors.New("no sub")
+	}
+	return tok.Subject(), nil
+}
+
+type tokenKey struct{}
+
+// WithToken returns ctx carrying tok, for middleware that already validated
+// it to hand to the handlers behind it.
+func WithToken(ctx context.Context, tok jwt.Token) context.Context {
+	return context.WithValue(ctx, tokenKey{}, tok)
+}
+
+// TokenFromContext returns the token stored by WithToken.
+func TokenFromContext(ctx context.Context) (jwt.Token, bool) {
+	tok, ok := ctx.Value(tokenKey{}).(jwt.Token)
+	return tok, ok
+}
+
 type LoginRequest struct {
 	Handle   string `json:"handle"`
 	Password string `json:"password"`
@@ -0,0 +1,253 @@
+// Package certificate issues signed result certificates for finished
+// matches. A certificate is a compact JWS (EdDSA) over Claims that anyone can
+// check offline against the key set published at /.well-known/jwks.json.
+package certificate
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+
+	"p2p-chess/internal/clock"
+	"p2p-chess/internal/engine"
+	"p2p-chess/internal/store"
+)
+
+const Issuer = "p2p-chess"
+
+var (
+	ErrNotFinished    = errors.New("match is not finished")
+	ErrBadCertificate = errors.New("invalid certificate")
+)
+
+var (
+	signingKey jwk.Key
+	publicKeys jwk.Set
+)
+
+type Player struct {
+	ID     string `json:"id"`
+	Handle string `json:"handle"`
+}
+
+// TimeControl repeats the tc_* columns; Mode and Periods give the full
+// control when the match has one stored.
+type TimeControl struct {
+	BaseMs  int            `json:"baseMs"`
+	IncMs   int            `json:"incMs"`
+	DelayMs int            `json:"delayMs"`
+	Mode    clock.Mode     `json:"mode,omitempty"`
+	Periods []clock.Period `json:"periods,omitempty"`
+}
+
+// Claims is the signed content of a certificate. PGNSHA256 covers the SAN
+// movetext and result as produced by engine.MoveText.
+type Claims struct {
+	Issuer      string      `json:"iss"`
+	IssuedAt    int64       `json:"iat"`
+	MatchID     string      `json:"matchId"`
+	White       Player      `json:"white"`
+	Black       Player      `json:"black"`
+	TimeControl TimeControl `json:"tc"`
+	FEN         string      `json:"fen"`
+	PGNSHA256   string      `json:"pgnSha256"`
+	Result      string      `json:"result"`
+	Reason      string      `json:"reason"`
+	FinishedAt  time.Time   `json:"finishedAt"`
+}
+
+// Init loads the Ed25519 signing key from CERT_SIGNING_KEY, a base64 32-byte
+// seed. The key ID is its JWK thumbprint, so rotating the seed changes it.
+func Init() error {
+	sec := os.Getenv("CERT_SIGNING_KEY")
+	if sec == "" {
+		return errors.New("CERT_SIGNING_KEY not set")
+	}
+	seed, err := base64.StdEncoding.DecodeString(sec)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return errors.New("CERT_SIGNING_KEY must be a base64 32-byte Ed25519 seed")
+	}
+	priv, err := jwk.FromRaw(ed25519.NewKeyFromSeed(seed))
+	if err != nil {
+		return err
+	}
+	pub, err := jwk.PublicKeyOf(priv)
+	if err != nil {
+		return err
+	}
+	thumb, err := pub.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	kid := base64.RawURLEncoding.EncodeToString(thumb)
+	for _, k := range []jwk.Key{priv, pub} {
+		if err := k.Set(jwk.KeyIDKey, kid); err != nil {
+			return err
+		}
+		if err := k.Set(jwk.AlgorithmKey, jwa.EdDSA); err != nil {
+			return err
+		}
+	}
+	if err := pub.Set(jwk.KeyUsageKey, jwk.ForSignature); err != nil {
+		return err
+	}
+	set := jwk.NewSet()
+	if err := set.AddKey(pub); err != nil {
+		return err
+	}
+	signingKey, publicKeys = priv, set
+	return nil
+}
+
+// KeySet is the public key set certificates verify against.
+func KeySet() jwk.Set {
+	return publicKeys
+}
+
+// Sign renders c as a compact JWS.
+func Sign(c Claims) (string, error) {
+	if signingKey == nil {
+		return "", errors.New("certificate not initialized")
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	b, err := jws.Sign(payload, jws.WithKey(jwa.EdDSA, signingKey))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Verify checks token against set and returns its claims.
+func Verify(token string, set jwk.Set) (*Claims, error) {
+	payload, err := jws.Verify([]byte(token), jws.WithKeySet(set))
+	if err != nil {
+		return nil, ErrBadCertificate
+	}
+	var c Claims
+	if err := json.Unmarshal(payload, &c); err != nil || c.Issuer != Issuer {
+		return nil, ErrBadCertificate
+	}
+	return &c, nil
+}
+
+// PGNHash is the digest stored in Claims.PGNSHA256.
+func PGNHash(moveText string) string {
+	sum := sha256.Sum256([]byte(moveText))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue builds, signs and stores the certificate of finished match matchID.
+func Issue(ctx context.Context, q store.DBTX, matchID string) (string, error) {
+	c := Claims{Issuer: Issuer, IssuedAt: time.Now().Unix(), MatchID: matchID}
+	var status string
+	var result, reason *string
+	var finishedAt *time.Time
+	var tc *clock.TimeControl
+	err := q.QueryRow(ctx, `
+SELECT m.status, m.result, m.reason, m.finished_at, m.last_fen, m.tc_base_ms, m.tc_inc_ms, m.tc_delay_ms, m.time_control,
+       w.id::text, w.handle, b.id::text, b.handle
+FROM matches m JOIN users w ON w.id = m.side_white JOIN users b ON b.id = m.side_black
+WHERE m.id = $1`, matchID).Scan(&status, &result, &reason, &finishedAt, &c.FEN,
+		&c.TimeControl.BaseMs, &c.TimeControl.IncMs, &c.TimeControl.DelayMs, &tc,
+		&c.White.ID, &c.White.Handle, &c.Black.ID, &c.Black.Handle)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && (status != "finished" || result == nil)) {
+		return "", ErrNotFinished
+	}
+	if err != nil {
+		return "", err
+	}
+	c.Result = *result
+	if tc != nil {
+		c.TimeControl.Mode, c.TimeControl.Periods = tc.Mode, tc.Periods
+	}
+	if reason != nil {
+		c.Reason = *reason
+	}
+	if finishedAt != nil {
+		c.FinishedAt = finishedAt.UTC()
+	}
+
+	text, err := moveText(ctx, q, matchID, c.FEN, c.Result)
+	if err != nil {
+		return "", err
+	}
+	c.PGNSHA256 = PGNHash(text)
+
+	token, err := Sign(c)
+	if err != nil {
+		return "", err
+	}
+	if _, err := q.Exec(ctx, "UPDATE matches SET certificate = $1 WHERE id = $2", token, matchID); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Load returns the stored certificate of matchID, issuing it first if the
+// match finished without one.
+func Load(ctx context.Context, q store.DBTX, matchID string) (string, error) {
+	var token *string
+	err := q.QueryRow(ctx, "SELECT certificate FROM matches WHERE id = $1", matchID).Scan(&token)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrNotFinished
+	}
+	if err != nil {
+		return "", err
+	}
+	if token != nil {
+		return *token, nil
+	}
+	return Issue(ctx, q, matchID)
+}
+
+// moveText replays the logged moves from the position before the first one,
+// or from finalFEN when no move was played.
+func moveText(ctx context.Context, q store.DBTX, matchID, finalFEN, result string) (string, error) {
+	rows, err := q.Query(ctx, "SELECT payload->>'uci', payload->>'fen_before' FROM match_events WHERE match_id = $1 AND type = 'move' ORDER BY seq", matchID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	start := finalFEN
+	var ucis []string
+	for rows.Next() {
+		var uci, before string
+		if err := rows.Scan(&uci, &before); err != nil {
+			return "", err
+		}
+		if len(ucis) == 0 {
+			start = before
+		}
+		ucis = append(ucis, uci)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return engine.MoveText(start, ucis, result)
+}
+
+// JWKSHandler publishes the certificate verification keys.
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	if publicKeys == nil {
+		http.Error(w, "Certificates unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	json.NewEncoder(w).Encode(publicKeys)
+}
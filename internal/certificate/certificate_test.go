@@ -0,0 +1,45 @@
+package certificate_test
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"p2p-chess/internal/certificate"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	t.Setenv("CERT_SIGNING_KEY", base64.StdEncoding.EncodeToString(seed))
+	assert.NoError(t, certificate.Init())
+
+	claims := certificate.Claims{
+		Issuer:    certificate.Issuer,
+		MatchID:   "m1",
+		White:     certificate.Player{ID: "u1", Handle: "alice"},
+		Black:     certificate.Player{ID: "u2", Handle: "bob"},
+		PGNSHA256: certificate.PGNHash("1. f3 e5 2. g4 Qh4# 0-1"),
+		Result:    "0-1",
+		Reason:    "Checkmate",
+	}
+	token, err := certificate.Sign(claims)
+	assert.NoError(t, err)
+
+	got, err := certificate.Verify(token, certificate.KeySet())
+	assert.NoError(t, err)
+	assert.Equal(t, claims, *got)
+
+	// Swapping the payload must break the signature.
+	parts := strings.Split(token, ".")
+	forged, _ := certificate.Sign(certificate.Claims{Issuer: certificate.Issuer, MatchID: "m1", Result: "1-0"})
+	parts[1] = strings.Split(forged, ".")[1]
+	_, err = certificate.Verify(strings.Join(parts, "."), certificate.KeySet())
+	assert.ErrorIs(t, err, certificate.ErrBadCertificate)
+}
+
+func TestInitRejectsBadSeed(t *testing.T) {
+	t.Setenv("CERT_SIGNING_KEY", base64.StdEncoding.EncodeToString([]byte("short")))
+	assert.Error(t, certificate.Init())
+}
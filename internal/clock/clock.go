@@ -7,12 +7,13 @@ import (
 
 const DriftToleranceMs = 250
 
-func CalculateElapsed(lastTick time.Time, now time.Time, delay int) int64 {
-	elapsed := now.Sub(lastTick).Milliseconds()
-	if elapsed > int64(delay) {
-		return elapsed - int64(delay)
+// CalculateElapsed is how long a clock started at lastTick has run by now.
+// A zero lastTick means the clock has not started yet.
+func CalculateElapsed(lastTick time.Time, now time.Time) int64 {
+	if lastTick.IsZero() {
+		return 0
 	}
-	return 0
+	return max(now.Sub(lastTick).Milliseconds(), 0)
 }
 
 type ClockState struct {
@@ -21,39 +22,132 @@ type ClockState struct {
 	SideToMove    string
 	LastTickWhite time.Time
 	LastTickBlack time.Time
-	IncMs         int
-	DelayMs       int
+	TC            TimeControl
+	// MovesWhite and MovesBlack count the moves each side completed, which
+	// places them in a period of TC.
+	MovesWhite int
+	MovesBlack int
+	// LagCompMs is credited back to the mover on the next update.
+	LagCompMs int
 }
 
+// UpdateClocks charges side for the time since its clock started, less
+// LagCompMs, and credits the move as TC's mode and period say. A move that
+// completes a period adds the next period's base, but only if the clock had
+// not already run out. The opponent's clock starts at tsServer. tsClient is
+// not trusted for timing: clients' clocks are not synchronized with the
+// server's, so only tsServer is charged.
 func UpdateClocks(state *ClockState, side string, tsServer time.Time, tsClient time.Time) (int, int, error) {
-	drift := tsServer.Sub(tsClient).Milliseconds()
-	if abs(drift) > DriftToleranceMs {
-		// Send correction via WS
-		// For now, adjust
+	mover, other, tick, moves, name := &state.MsWhite, &state.MsBlack, state.LastTickWhite, &state.MovesWhite, "white"
+	if side == "b" {
+		mover, other, tick, moves, name = &state.MsBlack, &state.MsWhite, state.LastTickBlack, &state.MovesBlack, "black"
 	}
-	var elapsed int64
-	if side == "w" {
-		elapsed = CalculateElapsed(state.LastTickWhite, tsServer, state.DelayMs)
-		state.MsWhite -= int(elapsed)
-		if state.MsWhite <= 0 {
-			return state.MsWhite, state.MsBlack, fmt.Errorf("white timeout")
-		}
-		state.MsWhite += state.IncMs
-		state.LastTickWhite = tsServer
-		state.SideToMove = "b"
-	} else {
-		elapsed = CalculateElapsed(state.LastTickBlack, tsServer, state.DelayMs)
-		state.MsBlack -= int(elapsed)
-		if state.MsBlack <= 0 {
-			return state.MsWhite, state.MsBlack, fmt.Errorf("black timeout")
-		}
-		state.MsBlack += state.IncMs
-		state.LastTickBlack = tsServer
-		state.SideToMove = "w"
+	tc := state.control()
+	i, done := tc.period(*moves + 1)
+	p := tc.Periods[i]
+
+	elapsed := compensate(CalculateElapsed(tick, tsServer), state.LagCompMs)
+	charged := int(tc.charge(p, elapsed))
+	*mover -= charged
+	if *mover <= 0 {
+		return state.MsWhite, state.MsBlack, fmt.Errorf("%s timeout", name)
+	}
+	switch tc.Mode {
+	case ModeBronstein:
+		*mover += min(int(elapsed), p.DelayMs)
+	case ModeHourglass:
+		*other += charged
+	}
+	*mover += p.IncMs
+	if done {
+		*mover += tc.next(i).BaseMs
 	}
+	*moves++
+
+	state.LastTickWhite, state.LastTickBlack = tsServer, tsServer
+	state.SideToMove = opponent(side)
 	return state.MsWhite, state.MsBlack, nil
 }
 
+// Drifted reports whether a client's declared clocks are further than
+// DriftToleranceMs from the server's.
+func Drifted(declaredWhite, declaredBlack, msWhite, msBlack int) bool {
+	return abs(int64(declaredWhite-msWhite)) > DriftToleranceMs || abs(int64(declaredBlack-msBlack)) > DriftToleranceMs
+}
+
+// Remaining is what is left on both clocks at now, with the side to move's
+// clock still running.
+func Remaining(state *ClockState, now time.Time) (int, int) {
+	w, b := state.MsWhite, state.MsBlack
+	mover, other, tick, moves := &w, &b, state.LastTickWhite, state.MovesWhite
+	if state.SideToMove == "b" {
+		mover, other, tick, moves = &b, &w, state.LastTickBlack, state.MovesBlack
+	}
+	tc := state.control()
+	i, _ := tc.period(moves + 1)
+	charged := int(tc.charge(tc.Periods[i], CalculateElapsed(tick, now)))
+	*mover -= charged
+	if tc.Mode == ModeHourglass {
+		*other += charged
+	}
+	return w, b
+}
+
+// Deadline is when the side to move flags if it does not move, or false if
+// its clock has not started.
+func Deadline(state *ClockState) (time.Time, bool) {
+	left, tick, moves := state.MsWhite, state.LastTickWhite, state.MovesWhite
+	if state.SideToMove == "b" {
+		left, tick, moves = state.MsBlack, state.LastTickBlack, state.MovesBlack
+	}
+	if tick.IsZero() {
+		return time.Time{}, false
+	}
+	if tc := state.control(); tc.Mode == ModeDelay {
+		i, _ := tc.period(moves + 1)
+		left += tc.Periods[i].DelayMs
+	}
+	return tick.Add(time.Duration(left) * time.Millisecond), true
+}
+
+// control is state's time control, or a bare clock without credits when
+// none is set.
+func (state *ClockState) control() TimeControl {
+	if len(state.TC.Periods) == 0 {
+		return Fischer(0, 0)
+	}
+	return state.TC
+}
+
+func opponent(side string) string {
+	if side == "w" {
+		return "b"
+	}
+	return "w"
+}
+
+// Lag compensation credits the mover with up to half its measured round
+// trip per move. It is drawn from a per-player quota that refills by
+// LagQuotaGainMs a move, so an inflated RTT buys only a bounded amount of
+// time. LagQuotaInitMs matches the lag_quota_*_ms column default.
+const (
+	MaxLagCompMs   = 500
+	LagQuotaInitMs = 1500
+	LagQuotaGainMs = 100
+	LagQuotaMaxMs  = 3000
+)
+
+// LagComp returns the compensation for a move that took elapsedMs with a
+// round trip of rttMs, and the mover's quota after it.
+func LagComp(rttMs, elapsedMs, quotaMs int) (int, int) {
+	comp := min(max(rttMs/2, 0), MaxLagCompMs, quotaMs, max(elapsedMs, 0))
+	return comp, min(quotaMs-comp+LagQuotaGainMs, LagQuotaMaxMs)
+}
+
+func compensate(elapsed int64, comp int) int64 {
+	return max(elapsed-int64(comp), 0)
+}
+
 func abs(i int64) int64 {
 	if i < 0 {
 		return -i
@@ -61,4 +155,4 @@ func abs(i int64) int64 {
 	return i
 }
 
-// TODO: Heartbeat handling, pause/forfeit
+// TODO: Pause/forfeit on heartbeat loss
@@ -15,8 +15,7 @@ func TestUpdateClocks(t *testing.T) {
 		SideToMove:    "w",
 		LastTickWhite: time.Now().Add(-2 * time.Second),
 		LastTickBlack: time.Now().Add(-10 * time.Second),
-		IncMs:         3000,
-		DelayMs:       0,
+		TC:            clock.Fischer(300000, 3000),
 	}
 	tsServer := time.Now()
 	tsClient := tsServer.Add(-100 * time.Millisecond) // Small drift
@@ -29,3 +28,226 @@ func TestUpdateClocks(t *testing.T) {
 }
 
 // Test timeout, drift > tolerance, etc.
+
+func TestUpdateClocksStartsOpponent(t *testing.T) {
+	state := &clock.ClockState{MsWhite: 60000, MsBlack: 60000, SideToMove: "w", TC: clock.Fischer(60000, 1000)}
+	tsServer := time.Now()
+
+	newWhite, newBlack, err := clock.UpdateClocks(state, "w", tsServer, tsServer)
+	assert.NoError(t, err)
+	assert.Equal(t, 61000, newWhite) // Clock not started yet, so only the increment
+	assert.Equal(t, 60000, newBlack)
+	assert.Equal(t, tsServer, state.LastTickBlack)
+}
+
+func TestDrifted(t *testing.T) {
+	assert.False(t, clock.Drifted(60000, 60000, 60000, 60000))
+	assert.False(t, clock.Drifted(60000-clock.DriftToleranceMs, 60000, 60000, 60000))
+	assert.True(t, clock.Drifted(60000, 61000, 60000, 60000))
+}
+
+func TestLagComp(t *testing.T) {
+	cases := []struct {
+		rtt, elapsed, quota int
+		comp, left          int
+	}{
+		{200, 3000, 1500, 100, 1500},
+		{4000, 3000, 1500, clock.MaxLagCompMs, 1100},
+		{800, 3000, 150, 150, 100},
+		{800, 50, 1500, 50, 1550},
+		{200, 3000, clock.LagQuotaMaxMs, 100, clock.LagQuotaMaxMs},
+		{-10, 3000, 1500, 0, 1600},
+	}
+	for _, c := range cases {
+		comp, left := clock.LagComp(c.rtt, c.elapsed, c.quota)
+		assert.Equal(t, c.comp, comp, "%+v", c)
+		assert.Equal(t, c.left, left, "%+v", c)
+	}
+}
+
+func TestUpdateClocksLagComp(t *testing.T) {
+	tsServer := time.Now()
+	state := &clock.ClockState{
+		MsWhite: 60000, MsBlack: 60000, SideToMove: "b",
+		LastTickBlack: tsServer.Add(-2 * time.Second), LagCompMs: 300,
+	}
+
+	_, newBlack, err := clock.UpdateClocks(state, "b", tsServer, tsServer)
+	assert.NoError(t, err)
+	assert.Equal(t, 58300, newBlack)
+}
+
+func TestRemaining(t *testing.T) {
+	now := time.Now()
+	state := &clock.ClockState{MsWhite: 60000, MsBlack: 50000, SideToMove: "w", LastTickWhite: now.Add(-5 * time.Second)}
+
+	w, b := clock.Remaining(state, now)
+	assert.Equal(t, 55000, w)
+	assert.Equal(t, 50000, b)
+}
+
+func TestUpdateClocksTimeControls(t *testing.T) {
+	const min = 60000
+	classical := clock.TimeControl{Mode: clock.ModeFischer, Periods: []clock.Period{
+		{Moves: 40, BaseMs: 90 * min, IncMs: 30000},
+		{BaseMs: 30 * min, IncMs: 30000},
+	}}
+	repeating := clock.TimeControl{Mode: clock.ModeFischer, Periods: []clock.Period{
+		{Moves: 40, BaseMs: 120 * min},
+		{Moves: 20, BaseMs: 60 * min},
+	}}
+	cases := []struct {
+		name    string
+		tc      clock.TimeControl
+		side    string
+		moves   int // completed by the mover before this move
+		ms      int // mover's clock before this move
+		elapsed int
+		mover   int
+		other   int
+		timeout bool
+	}{
+		{"fischer", clock.Fischer(min, 2000), "w", 0, min, 5000, 57000, min, false},
+		{"fischer black", clock.Fischer(min, 2000), "b", 10, 30000, 1000, 31000, min, false},
+		{"fischer flag", clock.Fischer(min, 2000), "w", 10, 1000, 1500, 0, 0, true},
+		{"bronstein within delay", clock.TimeControl{Mode: clock.ModeBronstein, Periods: []clock.Period{{BaseMs: min, DelayMs: 3000}}}, "w", 0, min, 2000, min, min, false},
+		{"bronstein past delay", clock.TimeControl{Mode: clock.ModeBronstein, Periods: []clock.Period{{BaseMs: min, DelayMs: 3000}}}, "w", 0, min, 5000, 58000, min, false},
+		{"bronstein flags inside delay", clock.TimeControl{Mode: clock.ModeBronstein, Periods: []clock.Period{{BaseMs: min, DelayMs: 3000}}}, "w", 5, 1000, 2000, 0, 0, true},
+		{"simple delay within delay", clock.TimeControl{Mode: clock.ModeDelay, Periods: []clock.Period{{BaseMs: min, DelayMs: 3000}}}, "w", 5, 1000, 2000, 1000, min, false},
+		{"simple delay past delay", clock.TimeControl{Mode: clock.ModeDelay, Periods: []clock.Period{{BaseMs: min, DelayMs: 3000}}}, "w", 0, min, 5000, 58000, min, false},
+		{"hourglass", clock.TimeControl{Mode: clock.ModeHourglass, Periods: []clock.Period{{BaseMs: min}}}, "w", 0, min, 5000, 55000, 65000, false},
+		{"hourglass flag", clock.TimeControl{Mode: clock.ModeHourglass, Periods: []clock.Period{{BaseMs: min}}}, "b", 3, 4000, 4000, 0, 0, true},
+		{"inside first period", classical, "w", 38, 10000, 4000, 36000, min, false},
+		{"completes first period", classical, "w", 39, 10000, 4000, 36000 + 30*min, min, false},
+		{"second period", classical, "w", 40, 10000, 4000, 36000, min, false},
+		{"flag on period's last move", classical, "w", 39, 3000, 4000, 0, 0, true},
+		{"repeating period", repeating, "w", 59, 10000, 4000, 6000 + 60*min, min, false},
+		{"repeating period again", repeating, "b", 79, 10000, 4000, 6000 + 60*min, min, false},
+		{"repeating mid period", repeating, "w", 70, 10000, 4000, 6000, min, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			now := time.Now()
+			state := &clock.ClockState{MsWhite: min, MsBlack: min, SideToMove: c.side, TC: c.tc}
+			if c.side == "w" {
+				state.MsWhite, state.MovesWhite, state.LastTickWhite = c.ms, c.moves, now.Add(-time.Duration(c.elapsed)*time.Millisecond)
+			} else {
+				state.MsBlack, state.MovesBlack, state.LastTickBlack = c.ms, c.moves, now.Add(-time.Duration(c.elapsed)*time.Millisecond)
+			}
+
+			w, b, err := clock.UpdateClocks(state, c.side, now, now)
+			if c.timeout {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			mover, other := w, b
+			if c.side == "b" {
+				mover, other = b, w
+			}
+			assert.Equal(t, c.mover, mover)
+			assert.Equal(t, c.other, other)
+			assert.Equal(t, c.moves+1, state.MovesWhite+state.MovesBlack)
+		})
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	tick := time.Now()
+	state := &clock.ClockState{MsWhite: 10000, MsBlack: 10000, SideToMove: "w", LastTickWhite: tick, TC: clock.Fischer(10000, 0)}
+	at, ok := clock.Deadline(state)
+	assert.True(t, ok)
+	assert.Equal(t, tick.Add(10*time.Second), at)
+
+	state.TC = clock.SuddenDeath(10000, 0, 5000)
+	at, _ = clock.Deadline(state)
+	assert.Equal(t, tick.Add(15*time.Second), at)
+
+	state.SideToMove = "b"
+	_, ok = clock.Deadline(state)
+	assert.False(t, ok)
+}
+
+func TestMaxCredit(t *testing.T) {
+	classical := clock.TimeControl{Mode: clock.ModeFischer, Periods: []clock.Period{
+		{Moves: 40, BaseMs: 5400000, IncMs: 30000},
+		{BaseMs: 1800000, IncMs: 30000},
+	}}
+	assert.Equal(t, 30000, classical.MaxCredit(1))
+	assert.Equal(t, 1830000, classical.MaxCredit(40))
+	assert.Equal(t, 30000, classical.MaxCredit(41))
+	assert.Equal(t, 0, clock.SuddenDeath(60000, 0, 3000).MaxCredit(1))
+	assert.Equal(t, 3000, clock.TimeControl{Mode: clock.ModeBronstein, Periods: []clock.Period{{BaseMs: 60000, DelayMs: 3000}}}.MaxCredit(7))
+}
+
+func TestValidateTimeControl(t *testing.T) {
+	cases := []struct {
+		tc clock.TimeControl
+		ok bool
+	}{
+		{clock.Fischer(180000, 2000), true},
+		{clock.SuddenDeath(180000, 0, 5000), true},
+		{clock.TimeControl{Mode: clock.ModeHourglass, Periods: []clock.Period{{BaseMs: 60000}}}, true},
+		{clock.TimeControl{Mode: clock.ModeFischer, Periods: []clock.Period{{Moves: 40, BaseMs: 5400000}, {BaseMs: 1800000}}}, true},
+		{clock.TimeControl{Mode: "blitz", Periods: []clock.Period{{BaseMs: 60000}}}, false},
+		{clock.TimeControl{Mode: clock.ModeFischer}, false},
+		{clock.Fischer(0, 2000), false},
+		{clock.TimeControl{Mode: clock.ModeFischer, Periods: []clock.Period{{BaseMs: 60000}, {BaseMs: 60000}}}, false},
+		{clock.TimeControl{Mode: clock.ModeFischer, Periods: []clock.Period{{BaseMs: 60000, DelayMs: 2000}}}, false},
+		{clock.TimeControl{Mode: clock.ModeHourglass, Periods: []clock.Period{{BaseMs: 60000, IncMs: 2000}}}, false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.ok, c.tc.Validate() == nil, "%+v", c.tc)
+	}
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		spec  string
+		want  clock.TimeControl
+		canon string
+		speed clock.Speed
+	}{
+		{"3+2", clock.Fischer(180000, 2000), "3+2", clock.SpeedBlitz},
+		{"10+0", clock.Fischer(600000, 0), "10+0", clock.SpeedRapid},
+		{"15|10", clock.Fischer(900000, 10000), "15+10", clock.SpeedRapid},
+		{"1", clock.Fischer(60000, 0), "1+0", clock.SpeedBullet},
+		{"0.5+0", clock.Fischer(30000, 0), "0.5+0", clock.SpeedBullet},
+		{"5d3", clock.SuddenDeath(300000, 0, 3000), "5d3", clock.SpeedBlitz},
+		{"5b3", clock.TimeControl{Mode: clock.ModeBronstein, Periods: []clock.Period{{BaseMs: 300000, DelayMs: 3000}}}, "5b3", clock.SpeedBlitz},
+		{"h1", clock.TimeControl{Mode: clock.ModeHourglass, Periods: []clock.Period{{BaseMs: 60000}}}, "h1", clock.SpeedBullet},
+		{"90/40+30", clock.TimeControl{Mode: clock.ModeFischer, Periods: []clock.Period{{Moves: 40, BaseMs: 5400000, IncMs: 30000}}}, "90/40+30", clock.SpeedClassical},
+		{"90/40+30, 30+30", clock.TimeControl{Mode: clock.ModeFischer, Periods: []clock.Period{
+			{Moves: 40, BaseMs: 5400000, IncMs: 30000}, {BaseMs: 1800000, IncMs: 30000},
+		}}, "90/40+30,30+30", clock.SpeedClassical},
+	}
+	for _, c := range cases {
+		got, err := clock.Parse(c.spec)
+		assert.NoError(t, err, c.spec)
+		assert.Equal(t, c.want, got, c.spec)
+		assert.Equal(t, c.canon, got.String(), c.spec)
+		assert.Equal(t, c.speed, got.Speed(), c.spec)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, spec := range []string{
+		"", "blitz!", "3+", "+2", "0+1", "0.1+0", "600+0", "3+999", "5d90", "90/0+30",
+		"90/40+30,30+30,15+30,5+30", "30+30,90/40+30", "10+5,5d3", "h3+2", "3+2+1",
+		"3+99999999999999999999", "3+9223372036854775", "90/99999999999999999999+30", "99999999999999999999+0",
+	} {
+		_, err := clock.Parse(spec)
+		assert.ErrorIs(t, err, clock.ErrBadTimeControl, spec)
+	}
+}
+
+func TestLookupPresets(t *testing.T) {
+	for _, p := range clock.Presets {
+		tc, err := clock.Lookup(p.Name)
+		assert.NoError(t, err, p.Name)
+		assert.Equal(t, p.Speed, tc.Speed(), p.Name)
+	}
+	tc, err := clock.Lookup("blitz")
+	assert.NoError(t, err)
+	assert.Equal(t, "3+2", tc.String())
+}
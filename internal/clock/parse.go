@@ -0,0 +1,173 @@
+package clock
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Speed is the category a time control is played and rated in.
+type Speed string
+
+const (
+	SpeedBullet    Speed = "bullet"
+	SpeedBlitz     Speed = "blitz"
+	SpeedRapid     Speed = "rapid"
+	SpeedClassical Speed = "classical"
+)
+
+// Preset is a named time control offered in quickplay.
+type Preset struct {
+	Name  string `json:"name"`
+	Spec  string `json:"tc"`
+	Speed Speed  `json:"speed"`
+}
+
+// Presets can be requested by name instead of a spec.
+var Presets = []Preset{
+	{"bullet", "1+0", SpeedBullet},
+	{"bullet-2", "2+1", SpeedBullet},
+	{"blitz", "3+2", SpeedBlitz},
+	{"blitz-5", "5+0", SpeedBlitz},
+	{"rapid", "10+0", SpeedRapid},
+	{"rapid-15", "15+10", SpeedRapid},
+	{"classical", "30+20", SpeedClassical},
+	{"fide", "90/40+30,30+30", SpeedClassical},
+}
+
+// Bounds on what Parse accepts.
+const (
+	minBaseMs    = 15000
+	maxBaseMs    = 180 * 60000
+	maxIncMs     = 180000
+	maxDelayMs   = 60000
+	maxPeriods   = 3
+	maxPerPeriod = 100
+)
+
+// A period is minutes, optionally "/moves", then "+" or "|" increment
+// seconds, "d" simple delay or "b" Bronstein delay seconds. A leading "h"
+// makes the control hourglass.
+var periodSpec = regexp.MustCompile(`^(\d+(?:\.\d+)?)(?:/(\d+))?(?:([+|db])(\d+))?$`)
+
+// Lookup resolves a preset name or a spec accepted by Parse.
+func Lookup(s string) (TimeControl, error) {
+	for _, p := range Presets {
+		if p.Name == s {
+			return Parse(p.Spec)
+		}
+	}
+	return Parse(s)
+}
+
+// Parse reads a time control such as "3+2", "10+0", "15|10", "5d3", "h1" or
+// "90/40+30,30+30", where stages are comma separated and a last stage with
+// a move count repeats. Unknown syntax and controls outside sane bounds
+// fail with ErrBadTimeControl.
+func Parse(s string) (TimeControl, error) {
+	s = strings.ToLower(strings.ReplaceAll(s, " ", ""))
+	tc := TimeControl{Mode: ModeFischer}
+	if rest, ok := strings.CutPrefix(s, "h"); ok {
+		tc.Mode, s = ModeHourglass, rest
+	}
+	stages := strings.Split(s, ",")
+	if len(stages) > maxPeriods {
+		return TimeControl{}, ErrBadTimeControl
+	}
+	for i, stage := range stages {
+		m := periodSpec.FindStringSubmatch(stage)
+		if m == nil {
+			return TimeControl{}, ErrBadTimeControl
+		}
+		// Out-of-range numbers are caught before they are scaled, so they
+		// cannot overflow past the bounds below.
+		minutes, err := strconv.ParseFloat(m[1], 64)
+		if err != nil || minutes > maxBaseMs/60000 {
+			return TimeControl{}, ErrBadTimeControl
+		}
+		p := Period{BaseMs: int(minutes*60000 + 0.5)}
+		if m[2] != "" {
+			p.Moves, err = strconv.Atoi(m[2])
+			if err != nil || p.Moves == 0 || p.Moves > maxPerPeriod {
+				return TimeControl{}, ErrBadTimeControl
+			}
+		}
+		if m[3] != "" {
+			secs, err := strconv.Atoi(m[4])
+			if err != nil || secs > maxIncMs/1000 {
+				return TimeControl{}, ErrBadTimeControl
+			}
+			mode := ModeFischer
+			switch m[3] {
+			case "+", "|":
+				p.IncMs = secs * 1000
+			case "d":
+				p.DelayMs, mode = secs*1000, ModeDelay
+			case "b":
+				p.DelayMs, mode = secs*1000, ModeBronstein
+			}
+			if tc.Mode == ModeHourglass || (i > 0 && mode != tc.Mode && secs > 0) {
+				return TimeControl{}, ErrBadTimeControl
+			}
+			if secs > 0 {
+				tc.Mode = mode
+			}
+		}
+		if p.BaseMs > maxBaseMs || p.IncMs > maxIncMs || p.DelayMs > maxDelayMs {
+			return TimeControl{}, ErrBadTimeControl
+		}
+		tc.Periods = append(tc.Periods, p)
+	}
+	if tc.Periods[0].BaseMs < minBaseMs {
+		return TimeControl{}, ErrBadTimeControl
+	}
+	if err := tc.Validate(); err != nil {
+		return TimeControl{}, err
+	}
+	return tc, nil
+}
+
+// String is tc in the syntax Parse reads, so equal controls render alike.
+func (tc TimeControl) String() string {
+	stages := make([]string, len(tc.Periods))
+	for i, p := range tc.Periods {
+		s := strconv.FormatFloat(float64(p.BaseMs)/60000, 'f', -1, 64)
+		if p.Moves > 0 {
+			s += fmt.Sprintf("/%d", p.Moves)
+		}
+		switch tc.Mode {
+		case ModeFischer:
+			s += fmt.Sprintf("+%d", p.IncMs/1000)
+		case ModeDelay:
+			s += fmt.Sprintf("d%d", p.DelayMs/1000)
+		case ModeBronstein:
+			s += fmt.Sprintf("b%d", p.DelayMs/1000)
+		}
+		stages[i] = s
+	}
+	s := strings.Join(stages, ",")
+	if tc.Mode == ModeHourglass {
+		s = "h" + s
+	}
+	return s
+}
+
+// Speed categorises tc by its estimated length for a 40-move game: the
+// first period's base plus 40 increments or delays.
+func (tc TimeControl) Speed() Speed {
+	if len(tc.Periods) == 0 {
+		return SpeedBullet
+	}
+	p := tc.Periods[0]
+	est := p.BaseMs + 40*(p.IncMs+p.DelayMs)
+	switch {
+	case est < 180000:
+		return SpeedBullet
+	case est < 480000:
+		return SpeedBlitz
+	case est < 1500000:
+		return SpeedRapid
+	}
+	return SpeedClassical
+}
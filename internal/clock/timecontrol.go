@@ -0,0 +1,140 @@
+package clock
+
+import "errors"
+
+var ErrBadTimeControl = errors.New("invalid time control")
+
+// Mode is how a time control credits a player for each move.
+type Mode string
+
+const (
+	// ModeFischer adds the period's increment after every move.
+	ModeFischer Mode = "fischer"
+	// ModeBronstein refunds the time a move used, up to the delay.
+	ModeBronstein Mode = "bronstein"
+	// ModeDelay (simple or US delay) holds the clock for the delay before
+	// it starts running down.
+	ModeDelay Mode = "delay"
+	// ModeHourglass moves the time a player uses onto the opponent's clock.
+	ModeHourglass Mode = "hourglass"
+)
+
+// Period is one stage of a time control. BaseMs is added to a player's clock
+// when they reach the period; Moves is how many of their moves it lasts, 0
+// for the rest of the game. A last period with Moves set repeats.
+type Period struct {
+	Moves   int `json:"moves,omitempty"`
+	BaseMs  int `json:"baseMs"`
+	IncMs   int `json:"incMs,omitempty"`
+	DelayMs int `json:"delayMs,omitempty"`
+}
+
+// TimeControl is a match's full time control, e.g. 40 moves in 90 minutes
+// then 30 minutes with a 30 second increment:
+//
+//	TimeControl{Mode: ModeFischer, Periods: []Period{
+//		{Moves: 40, BaseMs: 90 * 60000, IncMs: 30000},
+//		{BaseMs: 30 * 60000, IncMs: 30000},
+//	}}
+type TimeControl struct {
+	Mode    Mode     `json:"mode"`
+	Periods []Period `json:"periods"`
+}
+
+// Fischer is a single period of baseMs with an incMs increment.
+func Fischer(baseMs, incMs int) TimeControl {
+	return TimeControl{Mode: ModeFischer, Periods: []Period{{BaseMs: baseMs, IncMs: incMs}}}
+}
+
+// SuddenDeath is the single-period control described by the tc_* columns of
+// a match: simple delay when delayMs is set, Fischer otherwise.
+func SuddenDeath(baseMs, incMs, delayMs int) TimeControl {
+	tc := Fischer(baseMs, incMs)
+	if delayMs > 0 {
+		tc.Mode = ModeDelay
+		tc.Periods[0].DelayMs = delayMs
+	}
+	return tc
+}
+
+// Validate checks tc is playable: a known mode, a first period with time on
+// it, and only the last period open-ended.
+func (tc TimeControl) Validate() error {
+	switch tc.Mode {
+	case ModeFischer, ModeBronstein, ModeDelay, ModeHourglass:
+	default:
+		return ErrBadTimeControl
+	}
+	if len(tc.Periods) == 0 || tc.Periods[0].BaseMs <= 0 {
+		return ErrBadTimeControl
+	}
+	for i, p := range tc.Periods {
+		if p.Moves < 0 || p.BaseMs < 0 || p.IncMs < 0 || p.DelayMs < 0 {
+			return ErrBadTimeControl
+		}
+		if p.Moves == 0 && i != len(tc.Periods)-1 {
+			return ErrBadTimeControl
+		}
+		delayed := tc.Mode == ModeBronstein || tc.Mode == ModeDelay
+		if (p.DelayMs > 0 && !delayed) || (p.IncMs > 0 && tc.Mode == ModeHourglass) {
+			return ErrBadTimeControl
+		}
+	}
+	return nil
+}
+
+// InitialMs is what each clock starts with.
+func (tc TimeControl) InitialMs() int {
+	if len(tc.Periods) == 0 {
+		return 0
+	}
+	return tc.Periods[0].BaseMs
+}
+
+// period returns the index of the period a player's n-th move (from 1)
+// falls in, and whether that move completes it.
+func (tc TimeControl) period(n int) (int, bool) {
+	start := 0
+	for i, p := range tc.Periods {
+		if p.Moves == 0 {
+			return i, false
+		}
+		if n <= start+p.Moves {
+			return i, n == start+p.Moves
+		}
+		start += p.Moves
+	}
+	last := len(tc.Periods) - 1
+	return last, (n-start)%tc.Periods[last].Moves == 0
+}
+
+// next is the period that follows period i.
+func (tc TimeControl) next(i int) Period {
+	return tc.Periods[min(i+1, len(tc.Periods)-1)]
+}
+
+// charge is what elapsedMs of thinking on a move in period p costs.
+func (tc TimeControl) charge(p Period, elapsedMs int64) int64 {
+	if tc.Mode == ModeDelay {
+		return max(elapsedMs-int64(p.DelayMs), 0)
+	}
+	return elapsedMs
+}
+
+// MaxCredit bounds what a player's n-th move can add to their own clock:
+// increment, Bronstein refund and the base of a period it starts.
+func (tc TimeControl) MaxCredit(n int) int {
+	if len(tc.Periods) == 0 {
+		return 0
+	}
+	i, done := tc.period(n)
+	p := tc.Periods[i]
+	credit := p.IncMs
+	if tc.Mode == ModeBronstein {
+		credit += p.DelayMs
+	}
+	if done {
+		credit += tc.next(i).BaseMs
+	}
+	return credit
+}
@@ -0,0 +1,133 @@
+// Package color decides who takes white when two players are paired. It
+// only looks at each player's recent colours and an explicit preference, so
+// quickplay, challenges and tournament pairing can share it.
+package color
+
+import "crypto/rand"
+
+// Colours as recorded in a History.
+const (
+	White = 'w'
+	Black = 'b'
+)
+
+// HistoryLen is how many recent games a History needs to hold.
+const HistoryLen = 10
+
+// Preference is a colour the first player asked for, "white" or "black";
+// anything else leaves the choice to the allocator.
+type Preference string
+
+const (
+	PreferWhite Preference = "white"
+	PreferBlack Preference = "black"
+)
+
+// Reason records which rule decided an allocation.
+type Reason string
+
+const (
+	// ReasonPreference: the first player asked for their colour.
+	ReasonPreference Reason = "preference"
+	// ReasonStreak: the other colour would have been a third in a row.
+	ReasonStreak Reason = "streak"
+	// ReasonAlternate: players switch colour after their last game.
+	ReasonAlternate Reason = "alternate"
+	// ReasonBalance: white goes to whoever had it less often recently.
+	ReasonBalance Reason = "balance"
+	// ReasonRandom: nothing told the players apart, so a coin was tossed.
+	ReasonRandom Reason = "random"
+)
+
+// Player is someone to be seated. History holds the colours of their recent
+// games oldest first, e.g. "wbw", and may be empty.
+type Player struct {
+	ID      string
+	History string
+}
+
+// Allocation is who plays which side and why.
+type Allocation struct {
+	White  string `json:"white"`
+	Black  string `json:"black"`
+	Reason Reason `json:"reason"`
+}
+
+// Allocate seats a and b. An explicit preference of a wins; otherwise a
+// player who would get a third game in a row with one colour gets the other,
+// then players alternate from their last game, then white goes to whoever
+// had it less often, and finally to a coin toss. When both players want the
+// same colour equally strongly, the next rule breaks the tie.
+func Allocate(a, b Player, pref Preference) Allocation {
+	switch pref {
+	case PreferWhite:
+		return Allocation{White: a.ID, Black: b.ID, Reason: ReasonPreference}
+	case PreferBlack:
+		return Allocation{White: b.ID, Black: a.ID, Reason: ReasonPreference}
+	}
+
+	da, ra := desire(a.History)
+	db, rb := desire(b.History)
+	if da != db {
+		reason := ra
+		if abs(db) > abs(da) {
+			reason = rb
+		}
+		return seat(a, b, da > db, reason)
+	}
+	if ba, bb := balance(a.History), balance(b.History); ba != bb {
+		return seat(a, b, ba < bb, ReasonBalance)
+	}
+	return seat(a, b, toss(), ReasonRandom)
+}
+
+// desire is how strongly h asks for white next (negative for black) and
+// the rule that asks.
+func desire(h string) (int, Reason) {
+	n := len(h)
+	if n == 0 {
+		return 0, ""
+	}
+	sign := 1
+	if h[n-1] == White {
+		sign = -1
+	}
+	if n >= 2 && h[n-1] == h[n-2] {
+		return 2 * sign, ReasonStreak
+	}
+	return sign, ReasonAlternate
+}
+
+// balance is how many more whites than blacks h holds.
+func balance(h string) int {
+	n := 0
+	for i := 0; i < len(h); i++ {
+		switch h[i] {
+		case White:
+			n++
+		case Black:
+			n--
+		}
+	}
+	return n
+}
+
+func seat(a, b Player, aWhite bool, reason Reason) Allocation {
+	if aWhite {
+		return Allocation{White: a.ID, Black: b.ID, Reason: reason}
+	}
+	return Allocation{White: b.ID, Black: a.ID, Reason: reason}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func toss() bool {
+	var b [1]byte
+	_, _ = rand.Read(b[:])
+	return b[0]&1 == 0
+}
@@ -0,0 +1,48 @@
+package color_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"p2p-chess/internal/color"
+)
+
+func TestAllocate(t *testing.T) {
+	cases := []struct {
+		name       string
+		a, b       string
+		pref       color.Preference
+		wantWhite  string
+		wantReason color.Reason
+	}{
+		{"preference white", "ww", "bb", color.PreferWhite, "a", color.ReasonPreference},
+		{"preference black", "bb", "ww", color.PreferBlack, "b", color.ReasonPreference},
+		{"alternate both", "w", "b", "", "b", color.ReasonAlternate},
+		{"alternate one newcomer", "", "w", "", "a", color.ReasonAlternate},
+		{"streak beats alternate", "bww", "bw", "", "b", color.ReasonStreak},
+		{"streak of the other player", "bw", "bbb", "", "b", color.ReasonStreak},
+		{"streak outranks the same wish", "wb", "bbb", "", "b", color.ReasonStreak},
+		{"opposite streaks", "bb", "ww", "", "a", color.ReasonStreak},
+		{"same streak falls to balance", "bww", "www", "", "a", color.ReasonBalance},
+		{"same last colour falls to balance", "wwbw", "bbw", "", "b", color.ReasonBalance},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := color.Allocate(color.Player{ID: "a", History: c.a}, color.Player{ID: "b", History: c.b}, c.pref)
+			assert.Equal(t, c.wantWhite, got.White)
+			assert.Equal(t, c.wantReason, got.Reason)
+			assert.ElementsMatch(t, []string{"a", "b"}, []string{got.White, got.Black})
+		})
+	}
+}
+
+func TestAllocateTossesWhenEven(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 64; i++ {
+		got := color.Allocate(color.Player{ID: "a", History: "wb"}, color.Player{ID: "b", History: "wb"}, "random")
+		assert.Equal(t, color.ReasonRandom, got.Reason)
+		seen[got.White] = true
+	}
+	assert.Len(t, seen, 2)
+}
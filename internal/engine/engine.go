@@ -2,6 +2,8 @@ package engine
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	chess "github.com/corentings/chess/v2"
 )
@@ -32,4 +34,104 @@ func (e *Engine) GetFEN() string {
 	return e.Game.Position().String()
 }
 
-// TODO: Zobrist, SAN, etc.
+// Zobrist returns the Polyglot-compatible 64-bit key of fen. Move counters
+// are not part of the key, so repeated positions hash equal.
+func Zobrist(fen string) (uint64, error) {
+	h, err := chess.NewZobristHasher().HashPosition(fen)
+	if err != nil {
+		return 0, err
+	}
+	return chess.ZobristHashToUint64(h), nil
+}
+
+// ZobristHex is Zobrist formatted as the 16 hex digits stored in match_events.
+func ZobristHex(fen string) (string, error) {
+	z, err := Zobrist(fen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x", z), nil
+}
+
+// HalfMoveClock reads the fifty-move counter from fen.
+func HalfMoveClock(fen string) (int, error) {
+	fields := strings.Fields(fen)
+	if len(fields) < 5 {
+		return 0, fmt.Errorf("fen has no halfmove clock: %q", fen)
+	}
+	return strconv.Atoi(fields[4])
+}
+
+// MoveText renders the UCI moves played from fen as PGN movetext in SAN,
+// followed by result ("*" while the game is running).
+func MoveText(fen string, ucis []string, result string) (string, error) {
+	e, err := NewEngine(fen)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for i, uci := range ucis {
+		pos := e.Game.Position()
+		var san string
+		for _, mv := range e.Game.ValidMoves() {
+			if mv.String() == uci {
+				san = chess.AlgebraicNotation{}.Encode(pos, &mv)
+				break
+			}
+		}
+		if san == "" {
+			return "", fmt.Errorf("illegal move %d: %s", i+1, uci)
+		}
+		switch {
+		case pos.Turn() == chess.White:
+			fmt.Fprintf(&b, "%d. ", pos.Ply()/2+1)
+		case i == 0:
+			fmt.Fprintf(&b, "%d... ", pos.Ply()/2)
+		}
+		b.WriteString(san)
+		b.WriteByte(' ')
+		if err := e.ApplyMove(uci); err != nil {
+			return "", err
+		}
+	}
+	if result == "" {
+		result = "*"
+	}
+	b.WriteString(result)
+	return b.String(), nil
+}
+
+// CanMate reports whether side ("w" or "b") has enough material in fen to
+// ever deliver mate. Only the clear cases count as insufficient: a bare king,
+// or a lone bishop or knight against a bare king.
+func CanMate(fen, side string) (bool, error) {
+	fenOpt, err := chess.FEN(fen)
+	if err != nil {
+		return false, err
+	}
+	color := chess.White
+	if side == "b" {
+		color = chess.Black
+	}
+	var own, minors, theirs int
+	for _, p := range chess.NewGame(fenOpt).Position().Board().SquareMap() {
+		if p.Type() == chess.King {
+			continue
+		}
+		if p.Color() != color {
+			theirs++
+			continue
+		}
+		own++
+		if p.Type() == chess.Bishop || p.Type() == chess.Knight {
+			minors++
+		}
+	}
+	switch {
+	case own == 0:
+		return false, nil
+	case own == 1 && minors == 1 && theirs == 0:
+		return false, nil
+	}
+	return true, nil
+}
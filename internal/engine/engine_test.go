@@ -0,0 +1,75 @@
+package engine_test
+
+import (
+	"p2p-chess/internal/engine"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZobristStartPosition(t *testing.T) {
+	// Reference key from the Polyglot book format specification.
+	z, err := engine.Zobrist("rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x463b96181691fc9c), z)
+}
+
+func TestZobristIgnoresMoveCounters(t *testing.T) {
+	a, err := engine.ZobristHex("rnbqkbnr/pppppppp/8/8/8/5N2/PPPPPPPP/RNBQKB1R b KQkq - 1 1")
+	assert.NoError(t, err)
+	b, err := engine.ZobristHex("rnbqkbnr/pppppppp/8/8/8/5N2/PPPPPPPP/RNBQKB1R b KQkq - 5 3")
+	assert.NoError(t, err)
+	assert.Equal(t, a, b)
+	assert.Len(t, a, 16)
+}
+
+func TestZobristSkipsUncapturableEnPassant(t *testing.T) {
+	// After 1.e4 no black pawn can take on e3, so Polyglot leaves it out.
+	withEP, _ := engine.Zobrist("rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1")
+	noEP, _ := engine.Zobrist("rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq - 0 1")
+	assert.Equal(t, uint64(0x823c9b50fd114196), withEP)
+	assert.Equal(t, withEP, noEP)
+}
+
+func TestHalfMoveClock(t *testing.T) {
+	n, err := engine.HalfMoveClock("8/8/8/4k3/8/8/4K3/8 w - - 99 120")
+	assert.NoError(t, err)
+	assert.Equal(t, 99, n)
+}
+
+func TestMoveText(t *testing.T) {
+	start := "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
+	text, err := engine.MoveText(start, []string{"f2f3", "e7e5", "g2g4", "d8h4"}, "0-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "1. f3 e5 2. g4 Qh4# 0-1", text)
+
+	// Starting with black to move numbers the first move "N...".
+	text, err = engine.MoveText("rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1", []string{"e7e5", "g1f3"}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "1... e5 2. Nf3 *", text)
+
+	_, err = engine.MoveText(start, []string{"e2e5"}, "")
+	assert.Error(t, err)
+}
+
+func TestCanMate(t *testing.T) {
+	cases := []struct {
+		fen  string
+		side string
+		want bool
+	}{
+		{"4k3/8/8/8/8/8/8/4K3 w - - 0 1", "w", false},
+		{"4k3/8/8/8/8/8/8/2B1K3 w - - 0 1", "w", false},
+		{"4k3/8/8/8/8/8/8/1N2K3 w - - 0 1", "w", false},
+		{"4k3/4p3/8/8/8/8/8/1N2K3 w - - 0 1", "w", true},
+		{"4k3/8/8/8/8/8/8/R3K3 w - - 0 1", "w", true},
+		{"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1", "w", true},
+		{"4k3/8/8/8/8/8/8/1NB1K3 w - - 0 1", "w", true},
+		{"4k3/8/8/8/8/8/8/R3K3 w - - 0 1", "b", false},
+	}
+	for _, c := range cases {
+		got, err := engine.CanMate(c.fen, c.side)
+		assert.NoError(t, err)
+		assert.Equal(t, c.want, got, "%s %s", c.fen, c.side)
+	}
+}
@@ -0,0 +1,49 @@
+package http_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"p2p-chess/internal/auth"
+	apihttp "p2p-chess/internal/http"
+	"p2p-chess/internal/signaling"
+)
+
+// The override handler needs the admin's ID after AdminMiddleware let the
+// request through; a malformed body is rejected only once both accepted it.
+func TestAdminOverrideThroughMiddleware(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	assert.NoError(t, auth.Init())
+	router := apihttp.NewRouter(nil, signaling.NewHub(nil))
+
+	admin, err := auth.GenerateToken("00000000-0000-0000-0000-000000000001", "admin")
+	assert.NoError(t, err)
+	player, err := auth.GenerateToken("00000000-0000-0000-0000-000000000002", "player")
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"admin bearer token", "Bearer " + admin, http.StatusBadRequest},
+		{"bare token", admin, http.StatusForbidden},
+		{"player token", "Bearer " + player, http.StatusForbidden},
+		{"no token", "", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/admin/disputes/d1/override", strings.NewReader("{"))
+			if c.header != "" {
+				req.Header.Set("Authorization", c.header)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			assert.Equal(t, c.want, rec.Code)
+		})
+	}
+}
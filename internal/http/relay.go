@@ -0,0 +1,111 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"p2p-chess/internal/proto"
+	"p2p-chess/internal/referee"
+	"p2p-chess/internal/signaling"
+	"p2p-chess/internal/store"
+)
+
+var errMalformed = errors.New("malformed frame")
+
+// switchToRelayed flips the match to server relay and tells both seats where
+// play continues, so neither side loses its place in the seq.
+func switchToRelayed(ctx context.Context, s *store.Store, hub *signaling.Hub, peer *signaling.Peer) error {
+	snap, err := referee.SwitchToRelayed(ctx, s, peer.MatchID)
+	if err != nil {
+		return err
+	}
+	frame, err := proto.Encode(proto.ActionRelayed, snap)
+	if err != nil {
+		return err
+	}
+	return hub.Notify(ctx, peer.MatchID, "", frame)
+}
+
+// relayGameFrame runs a move, resign or draw frame past the referee and, if
+// it holds up, records it and forwards it verbatim to the opponent. Moves are
+// acknowledged to the sender once recorded.
+func relayGameFrame(ctx context.Context, s *store.Store, hub *signaling.Hub, peer *signaling.Peer, action string, msg []byte, reply func(string, any)) error {
+	switch action {
+	case proto.ActionMove:
+		if err := referee.RequireRelayed(ctx, s, peer.MatchID); err != nil {
+			return err
+		}
+		var req referee.AppendRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			return errMalformed
+		}
+		req.Side = peer.Side
+		if req.TsClient == "" {
+			req.TsClient = time.Now().UTC().Format(time.RFC3339)
+		}
+		res, err := referee.Append(ctx, s, peer.MatchID, req)
+		if err != nil {
+			return replyCorrection(err, reply)
+		}
+		reply(proto.ActionAck, proto.Ack{Seq: res.Seq, Hash: res.Hash})
+
+	case proto.ActionResign:
+		var m proto.Resign
+		if err := json.Unmarshal(msg, &m); err != nil {
+			return errMalformed
+		}
+		if m.By != "" && m.By != peer.Side {
+			return referee.ErrWrongSide
+		}
+		if err := referee.RequireRelayed(ctx, s, peer.MatchID); err != nil {
+			return err
+		}
+		if _, err := referee.Resign(ctx, s, peer.MatchID, peer.Side, referee.ControlRequest{Seq: m.Seq, Sig: m.Sig, PrevHash: m.PrevHash}); err != nil {
+			return replyCorrection(err, reply)
+		}
+
+	case proto.ActionDrawOffer:
+		var m proto.DrawOffer
+		if err := json.Unmarshal(msg, &m); err != nil {
+			return errMalformed
+		}
+		if err := referee.RequireRelayed(ctx, s, peer.MatchID); err != nil {
+			return err
+		}
+		if err := referee.OfferDraw(ctx, s, peer.MatchID, peer.Side, referee.ControlRequest{Seq: m.Seq, Sig: m.Sig, PrevHash: m.PrevHash}); err != nil {
+			return replyCorrection(err, reply)
+		}
+
+	case proto.ActionDrawResponse:
+		var m proto.DrawResponse
+		if err := json.Unmarshal(msg, &m); err != nil {
+			return errMalformed
+		}
+		if err := referee.RequireRelayed(ctx, s, peer.MatchID); err != nil {
+			return err
+		}
+		if _, err := referee.RespondDraw(ctx, s, peer.MatchID, peer.Side, referee.ControlRequest{Seq: m.Seq, Accept: m.Accept, Sig: m.Sig, PrevHash: m.PrevHash}); err != nil {
+			return replyCorrection(err, reply)
+		}
+	}
+
+	if err := hub.Relay(ctx, peer, msg); err != nil {
+		log.Printf("relay: forward %s: %v", action, err)
+		return err
+	}
+	return nil
+}
+
+// replyCorrection answers a divergence with the referee's correction instead
+// of an error frame; anything else is passed back.
+func replyCorrection(err error, reply func(string, any)) error {
+	var ce *referee.CorrectionError
+	if errors.As(err, &ce) {
+		reply(proto.ActionCorrection, ce.Correction)
+		return nil
+	}
+	return err
+}
@@ -8,12 +8,15 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/websocket"
+	"github.com/lestrrat-go/jwx/v2/jwt"
 	"golang.org/x/time/rate"
 
 	"p2p-chess/internal/admin"
 	"p2p-chess/internal/auth"
+	"p2p-chess/internal/certificate"
 	"p2p-chess/internal/lobby"
 	"p2p-chess/internal/referee"
+	"p2p-chess/internal/signaling"
 	"p2p-chess/internal/store"
 )
 
@@ -58,7 +61,7 @@ func CorsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func NewRouter() *chi.Mux {
+func NewRouter(s *store.Store, hub *signaling.Hub) *chi.Mux {
 	r := chi.NewRouter()
 
 	// CORS first
@@ -93,14 +96,53 @@ func NewRouter() *chi.Mux {
 	r.Group(func(r chi.Router) {
 		r.Use(RateLimitMiddleware(5, 1))
 		r.Post("/v1/match/quick", lobby.QuickplayHandler)
+		r.Delete("/v1/match/quick", lobby.CancelQuickplayHandler)
 	})
 
+	// Lobby browsing, challenges, seeks and invites: clients poll these and a lobby
+	// page fires several at once, so allow a burst.
+	r.Group(func(r chi.Router) {
+		r.Use(RateLimitMiddleware(5, 20))
+		r.Get("/v1/match/quick", lobby.QueueStatusHandler)
+		r.Get("/v1/match/quick/presets", lobby.PresetsHandler)
+		r.Post("/v1/challenges", lobby.CreateChallengeHandler)
+		r.Get("/v1/challenges", lobby.ListChallengesHandler)
+		r.Post("/v1/challenges/{id}/accept", lobby.AcceptChallengeHandler)
+		r.Post("/v1/challenges/{id}/decline", lobby.DeclineChallengeHandler)
+		r.Delete("/v1/challenges/{id}", lobby.CancelChallengeHandler)
+		r.Post("/v1/seeks", lobby.CreateSeekHandler)
+		r.Get("/v1/seeks", lobby.ListSeeksHandler)
+		r.Post("/v1/seeks/{id}/accept", lobby.AcceptSeekHandler)
+		r.Delete("/v1/seeks/{id}", lobby.CancelSeekHandler)
+		r.Post("/v1/invites", lobby.CreateInviteHandler)
+		r.Get("/v1/invites/{code}", lobby.InviteHandler)
+		r.Post("/v1/invites/{code}/join", lobby.JoinInviteHandler)
+		r.Delete("/v1/invites/{code}", lobby.RevokeInviteHandler)
+	})
+
+	r.Post("/v1/users/{userID}/block", lobby.BlockHandler)
+	r.Delete("/v1/users/{userID}/block", lobby.UnblockHandler)
+
+	// Lobby notifications (pairing) over SSE
+	r.Get("/v1/lobby/events", lobby.EventsHandler(s))
+
 	// Append/Resume
 	r.Post("/v1/match/{id}/append", referee.AppendHandler)
+	r.Post("/v1/match/{id}/append/batch", referee.AppendBatchHandler)
 	r.Post("/v1/match/{id}/resume", lobby.ResumeHandler)
 
+	// Resign/Draw
+	r.Post("/v1/match/{id}/resign", referee.ResignHandler)
+	r.Post("/v1/match/{id}/draw/offer", referee.DrawOfferHandler)
+	r.Post("/v1/match/{id}/draw/respond", referee.DrawResponseHandler)
+	r.Post("/v1/match/{id}/claim", referee.ClaimHandler)
+	r.Get("/v1/match/{id}/chain", referee.ChainHandler)
+	r.Get("/v1/match/{id}/certificate", referee.CertificateHandler)
+	r.Post("/v1/match/{id}/dispute", referee.DisputeHandler)
+	r.Get("/.well-known/jwks.json", certificate.JWKSHandler)
+
 	// WS signaling
-	r.Get("/v1/ws/signal", SignalingWS)
+	r.Get("/v1/ws/signal", SignalingWS(s, hub))
 
 	// Spectator SSE
 	r.Get("/v1/match/{id}/spectate", referee.SpectateHandler)
@@ -121,49 +163,36 @@ func NewRouter() *chi.Mux {
 		r.Use(AdminMiddleware)
 		r.Post("/v1/admin/ban/{userID}", admin.AdminBanHandler)
 		r.Post("/v1/admin/abort/{matchID}", admin.AdminAbortHandler)
+		r.Post("/v1/admin/verify/{matchID}", admin.AdminVerifyHandler)
+		r.Post("/v1/admin/verify", admin.AdminSweepHandler)
+		r.Get("/v1/admin/disputes", admin.AdminDisputesHandler)
+		r.Get("/v1/admin/disputes/{disputeID}", admin.AdminDisputeHandler)
+		r.Post("/v1/admin/disputes/{disputeID}/override", admin.AdminOverrideDisputeHandler)
 	})
 
 	return r
 }
 
-func SignalingWS(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		return
-	}
-	defer conn.Close()
-
-	for {
-		_, msg, err := conn.ReadMessage()
-		if err != nil {
-			break
-		}
-		if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-			break
-		}
-	}
-}
-
-func isAdmin(r *http.Request) bool {
-	tokenStr := r.Header.Get("Authorization")
-	if tokenStr == "" {
-		return false
-	}
-	token, err := auth.ValidateToken(tokenStr)
-	if err != nil {
-		return false
+// adminToken returns the bearer token on r if it carries the admin role.
+func adminToken(r *http.Request) (jwt.Token, bool) {
+	token, err := auth.TokenFromRequest(r)
+	if err != nil || token.Subject() == "" {
+		return nil, false
 	}
 	role, _ := token.Get("role")
-	return role == "admin"
+	return token, role == "admin"
 }
 
+// AdminMiddleware admits admins only and hands their token on through the
+// request context, see auth.TokenFromContext.
 func AdminMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !isAdmin(r) {
+		token, ok := adminToken(r)
+		if !ok {
 			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(auth.WithToken(r.Context(), token)))
 	})
 }
 
@@ -0,0 +1,267 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"p2p-chess/internal/proto"
+	"p2p-chess/internal/referee"
+	"p2p-chess/internal/signaling"
+	"p2p-chess/internal/store"
+)
+
+const signalReadLimit = 64 << 10
+
+// Pings measure each player's round trip for lag compensation.
+const (
+	pingInterval = 5 * time.Second
+	pingTimeout  = time.Second
+)
+
+// SignalingWS binds a socket to the seat named by its join token and relays
+// offer/answer/ICE frames to the opposite player of that match. The token may
+// be passed as ?token= or in the join frame. The join's capabilities settle
+// the match's signature algorithm, and offering CapSigEd25519 registers the
+// player's public key. Pings and heartbeat frames feed the player's RTT
+// estimate for lag compensation.
+func SignalingWS(s *store.Store, hub *signaling.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetReadLimit(signalReadLimit)
+
+		out := make(chan []byte, 32)
+		done := make(chan struct{})
+		flushed := make(chan struct{})
+		go func() {
+			defer close(flushed)
+			ping := time.NewTicker(pingInterval)
+			defer ping.Stop()
+			for {
+				select {
+				case <-ping.C:
+					stamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+					if err := conn.WriteControl(websocket.PingMessage, []byte(stamp), time.Now().Add(pingTimeout)); err != nil {
+						return
+					}
+				case msg := <-out:
+					if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+						return
+					}
+				case <-done:
+					// Drain whatever was queued before the reader gave up,
+					// so a final error frame still reaches the client.
+					for {
+						select {
+						case msg := <-out:
+							if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+								return
+							}
+						default:
+							return
+						}
+					}
+				}
+			}
+		}()
+		defer func() {
+			close(done)
+			<-flushed
+		}()
+
+		send := func(action string, v any) {
+			frame, _ := proto.Encode(action, v)
+			select {
+			case out <- frame:
+			default:
+			}
+		}
+		sendErr := func(msg string) {
+			send(proto.ActionError, proto.Error{Message: msg})
+		}
+
+		var peer *signaling.Peer
+		conn.SetPongHandler(func(stamp string) error {
+			sent, err := strconv.ParseInt(stamp, 10, 64)
+			if peer == nil || err != nil {
+				return nil
+			}
+			rtt := int(time.Since(time.UnixMilli(sent)).Milliseconds())
+			if err := referee.RecordRTT(r.Context(), s, peer.MatchID, peer.Side, rtt); err != nil {
+				log.Printf("signaling: record rtt: %v", err)
+			}
+			return nil
+		})
+		defer func() {
+			if peer != nil {
+				ctx := context.Background()
+				hub.Leave(ctx, peer)
+				notifyPeer(ctx, hub, peer, false)
+			}
+		}()
+
+		queryToken := r.URL.Query().Get("token")
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var env proto.Envelope
+			if err := json.Unmarshal(msg, &env); err != nil {
+				sendErr("malformed frame")
+				continue
+			}
+
+			switch env.Action {
+			case proto.ActionJoin:
+				if peer != nil {
+					sendErr("already joined")
+					continue
+				}
+				var join proto.Join
+				_ = json.Unmarshal(msg, &join)
+				token := join.Token
+				if token == "" {
+					token = queryToken
+				}
+				seat, err := signaling.ResolveJoinToken(r.Context(), s, token)
+				if err != nil {
+					if !errors.Is(err, signaling.ErrInvalidToken) {
+						log.Printf("signaling: resolve token: %v", err)
+					}
+					sendErr("invalid join token")
+					return
+				}
+				if join.MatchID != "" && join.MatchID != seat.MatchID {
+					sendErr("not seated in match")
+					return
+				}
+				sigAlg, err := referee.NegotiateSigAlg(r.Context(), s, seat.MatchID, seat.Side, join.Caps, join.PubKey)
+				if err != nil {
+					sendErr(relayError(err))
+					return
+				}
+				peer, err = hub.Join(r.Context(), seat, out)
+				if err != nil {
+					if errors.Is(err, signaling.ErrSeatTaken) {
+						sendErr("seat already joined")
+					} else {
+						log.Printf("signaling: join: %v", err)
+						sendErr("join failed")
+					}
+					return
+				}
+				send(proto.ActionJoined, proto.Joined{MatchID: seat.MatchID, Side: seat.Side, SigAlg: sigAlg})
+				notifyPeer(r.Context(), hub, peer, true)
+
+			case proto.ActionOffer, proto.ActionAnswer, proto.ActionICE:
+				if peer == nil {
+					sendErr("join first")
+					continue
+				}
+				if env.MatchID != "" && env.MatchID != peer.MatchID {
+					sendErr("not seated in match")
+					continue
+				}
+				if err := hub.Relay(r.Context(), peer, msg); err != nil {
+					sendErr(err.Error())
+				}
+
+			case proto.ActionRelay:
+				if peer == nil {
+					sendErr("join first")
+					continue
+				}
+				if err := switchToRelayed(r.Context(), s, hub, peer); err != nil {
+					sendErr(relayError(err))
+				}
+
+			case proto.ActionMove, proto.ActionResign, proto.ActionDrawOffer, proto.ActionDrawResponse:
+				if peer == nil {
+					sendErr("join first")
+					continue
+				}
+				if env.MatchID != "" && env.MatchID != peer.MatchID {
+					sendErr("not seated in match")
+					continue
+				}
+				if err := relayGameFrame(r.Context(), s, hub, peer, env.Action, msg, send); err != nil {
+					sendErr(relayError(err))
+				}
+
+			case proto.ActionHeartbeat:
+				if peer == nil {
+					sendErr("join first")
+					continue
+				}
+				var hb proto.P2PHeartbeat
+				if err := json.Unmarshal(msg, &hb); err != nil {
+					sendErr("malformed frame")
+					continue
+				}
+				if err := heartbeat(r.Context(), s, peer, hb, send); err != nil {
+					sendErr(relayError(err))
+				}
+
+			default:
+				sendErr("unknown action")
+			}
+		}
+	}
+}
+
+// relayError turns a referee rejection into a message for the client without
+// leaking storage errors.
+func relayError(err error) string {
+	for _, known := range []error{
+		referee.ErrBadSignature, referee.ErrIllegalMove, referee.ErrBadTimestamp, referee.ErrTimeout,
+		referee.ErrMatchNotFound, referee.ErrNotRelayed, referee.ErrMatchOver, referee.ErrBadSeq, referee.ErrWrongSide,
+		referee.ErrDrawPending, referee.ErrNoDrawOffer, referee.ErrBadPublicKey, referee.ErrKeyMismatch, referee.ErrSigAlgMismatch,
+		errMalformed,
+	} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	log.Printf("relay error: %v", err)
+	return "relay failed"
+}
+
+// heartbeat records the RTT a client measured to its peer and, if it sent
+// the clocks it displays, corrects them when they drifted.
+func heartbeat(ctx context.Context, s *store.Store, peer *signaling.Peer, hb proto.P2PHeartbeat, reply func(string, any)) error {
+	if hb.RTT > 0 {
+		if err := referee.RecordRTT(ctx, s, peer.MatchID, peer.Side, hb.RTT); err != nil {
+			return err
+		}
+	}
+	if hb.MsWhite == nil || hb.MsBlack == nil {
+		return nil
+	}
+	cc, err := referee.CheckDisplayedClock(ctx, s, peer.MatchID, *hb.MsWhite, *hb.MsBlack)
+	if err != nil {
+		return err
+	}
+	if cc != nil {
+		reply(proto.ActionClockCorrection, cc)
+	}
+	return nil
+}
+
+// notifyPeer tells the opponent that p connected or went away.
+func notifyPeer(ctx context.Context, hub *signaling.Hub, p *signaling.Peer, connected bool) {
+	frame, _ := proto.Encode(proto.ActionPeer, proto.PeerStatus{Side: p.Side, Connected: connected})
+	if err := hub.Notify(ctx, p.MatchID, signaling.Opponent(p.Side), frame); err != nil {
+		log.Printf("signaling: notify peer: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package lobby
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gofrs/uuid"
+
+	"p2p-chess/internal/auth"
+	"p2p-chess/internal/store"
+)
+
+// BlockHandler stops the caller from ever being paired with {userID}.
+func BlockHandler(w http.ResponseWriter, r *http.Request) {
+	setBlock(w, r, true)
+}
+
+// UnblockHandler lifts a block set by BlockHandler.
+func UnblockHandler(w http.ResponseWriter, r *http.Request) {
+	setBlock(w, r, false)
+}
+
+func setBlock(w http.ResponseWriter, r *http.Request, block bool) {
+	userID, err := auth.UserIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	target := chi.URLParam(r, "userID")
+	if _, err := uuid.FromString(target); err != nil || target == userID {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+	s, err := store.New()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if block {
+		_, err = s.DB.Exec(r.Context(), `
+INSERT INTO user_blocks (blocker_id, blocked_id) SELECT $1, id FROM users WHERE id = $2
+ON CONFLICT DO NOTHING`, userID, target)
+	} else {
+		_, err = s.DB.Exec(r.Context(), "DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2", userID, target)
+	}
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// blockedEither reports whether a or b has blocked the other.
+func blockedEither(ctx context.Context, q store.DBTX, a, b string) (bool, error) {
+	var blocked bool
+	err := q.QueryRow(ctx, `
+SELECT EXISTS (SELECT 1 FROM user_blocks
+  WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1))`, a, b).Scan(&blocked)
+	return blocked, err
+}
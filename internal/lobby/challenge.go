@@ -0,0 +1,568 @@
+package lobby
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"p2p-chess/internal/auth"
+	"p2p-chess/internal/clock"
+	"p2p-chess/internal/color"
+	"p2p-chess/internal/engine"
+	"p2p-chess/internal/proto"
+	"p2p-chess/internal/referee"
+	"p2p-chess/internal/store"
+)
+
+// A challenge is addressed to one user, who may accept or decline it until
+// it expires. A seek is a challenge with no challenged_id: it is listed in
+// the lobby and anyone eligible may accept it. Both start their match
+// through startMatch, like quickplay.
+
+const (
+	ChallengeTTL = 10 * time.Minute
+	SeekTTL      = 30 * time.Minute
+
+	maxSeeksListed = 100
+)
+
+var (
+	ErrChallengeNotFound = errors.New("challenge not found")
+	ErrChallengeClosed   = errors.New("challenge is no longer open")
+	ErrUnknownHandle     = errors.New("no user with that handle")
+	ErrNotEligible       = errors.New("not eligible for this challenge")
+	ErrBadChallenge      = errors.New("invalid challenge")
+	ErrRatedCustomStart  = errors.New("rated games must start from the standard position")
+)
+
+// Colour preferences of the challenger.
+const (
+	ColorWhite  = "white"
+	ColorBlack  = "black"
+	ColorRandom = "random"
+)
+
+// ChallengeRequest creates a challenge (Handle set) or a seek. TC is a
+// preset or spec, see clock.Lookup; Color defaults to random. The rating
+// bounds only apply to seeks.
+type ChallengeRequest struct {
+	Handle    string `json:"handle,omitempty"`
+	TC        string `json:"tc"`
+	Color     string `json:"color,omitempty"`
+	Rated     bool   `json:"rated"`
+	FEN       string `json:"fen,omitempty"`
+	MinRating *int   `json:"minRating,omitempty"`
+	MaxRating *int   `json:"maxRating,omitempty"`
+}
+
+// Challenge is a stored challenge or seek. An open one past ExpiresAt
+// reads as expired.
+type Challenge struct {
+	ID        string    `json:"id"`
+	FromID    string    `json:"fromId"`
+	From      string    `json:"from"`
+	ToID      string    `json:"toId,omitempty"`
+	To        string    `json:"to,omitempty"`
+	TC        string    `json:"tc"`
+	Color     string    `json:"color"`
+	Rated     bool      `json:"rated"`
+	FEN       string    `json:"fen,omitempty"`
+	MinRating *int      `json:"minRating,omitempty"`
+	MaxRating *int      `json:"maxRating,omitempty"`
+	Status    string    `json:"status"`
+	MatchID   string    `json:"matchId,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	control clock.TimeControl
+}
+
+const challengeQuery = `
+SELECT c.id::text, c.challenger_id::text, u.handle, COALESCE(c.challenged_id::text, ''), COALESCE(v.handle, ''),
+  c.tc, c.time_control, c.color, c.rated, COALESCE(c.start_fen, ''), c.min_rating, c.max_rating,
+  c.status, COALESCE(c.match_id::text, ''), c.created_at, c.expires_at
+FROM challenges c JOIN users u ON u.id = c.challenger_id LEFT JOIN users v ON v.id = c.challenged_id`
+
+func scanChallenge(row pgx.Row) (*Challenge, error) {
+	var c Challenge
+	var control []byte
+	err := row.Scan(&c.ID, &c.FromID, &c.From, &c.ToID, &c.To, &c.TC, &control, &c.Color, &c.Rated, &c.FEN,
+		&c.MinRating, &c.MaxRating, &c.Status, &c.MatchID, &c.CreatedAt, &c.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrChallengeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(control, &c.control); err != nil {
+		return nil, err
+	}
+	if c.Status == "open" && !c.ExpiresAt.After(time.Now()) {
+		c.Status = "expired"
+	}
+	return &c, nil
+}
+
+func (c *Challenge) seek() bool {
+	return c.ToID == ""
+}
+
+// CanAccept says whether userID, rated rating, may take the open seat of c:
+// a direct challenge only by its recipient, a seek by anyone else within
+// its rating bounds. rating only matters for seeks.
+func (c *Challenge) CanAccept(userID string, rating float64) error {
+	if !c.seek() {
+		if userID != c.ToID {
+			return ErrNotEligible
+		}
+		return nil
+	}
+	if userID == c.FromID {
+		return ErrBadChallenge
+	}
+	if (c.MinRating != nil && rating < float64(*c.MinRating)) || (c.MaxRating != nil && rating > float64(*c.MaxRating)) {
+		return ErrNotEligible
+	}
+	return nil
+}
+
+func (c *Challenge) frame() *proto.Challenge {
+	return &proto.Challenge{
+		ID: c.ID, From: c.From, To: c.To, TC: c.TC, Color: c.Color, Rated: c.Rated, FEN: c.FEN,
+		Status: c.Status, ExpiresAt: c.ExpiresAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// StartPosition checks a requested start FEN is legal with a move to play,
+// and returns it normalised; the standard position comes back empty.
+func StartPosition(fen string) (string, error) {
+	if fen == "" {
+		return "", nil
+	}
+	e, err := engine.NewEngine(fen)
+	if err != nil || len(e.Game.ValidMoves()) == 0 {
+		return "", ErrBadChallenge
+	}
+	fen = e.GetFEN()
+	if fen == referee.StartFEN {
+		return "", nil
+	}
+	return fen, nil
+}
+
+// GameTerms checks the terms a challenge or invite offers and returns the
+// time control, colour preference and normalised start FEN.
+func GameTerms(spec, color, fen string, rated bool) (clock.TimeControl, string, string, error) {
+	tc, err := clock.Lookup(spec)
+	if err != nil {
+		return clock.TimeControl{}, "", "", err
+	}
+	switch color {
+	case "":
+		color = ColorRandom
+	case ColorWhite, ColorBlack, ColorRandom:
+	default:
+		return clock.TimeControl{}, "", "", ErrBadChallenge
+	}
+	fen, err = StartPosition(fen)
+	if err != nil {
+		return clock.TimeControl{}, "", "", err
+	}
+	if rated && fen != "" {
+		return clock.TimeControl{}, "", "", ErrRatedCustomStart
+	}
+	return tc, color, fen, nil
+}
+
+// CreateChallenge stores a challenge from userID, a seek when seek is set,
+// and tells the challenged player.
+func CreateChallenge(ctx context.Context, s *store.Store, userID string, req ChallengeRequest, seek bool) (*Challenge, error) {
+	tc, color, fen, err := GameTerms(req.TC, req.Color, req.FEN, req.Rated)
+	if err != nil {
+		return nil, err
+	}
+	req.Color = color
+
+	ttl := SeekTTL
+	var to *string
+	if seek {
+		if req.MinRating != nil && req.MaxRating != nil && *req.MinRating > *req.MaxRating {
+			return nil, ErrBadChallenge
+		}
+	} else {
+		ttl = ChallengeTTL
+		req.MinRating, req.MaxRating = nil, nil
+		var id string
+		err := s.DB.QueryRow(ctx, "SELECT id::text FROM users WHERE handle = $1", req.Handle).Scan(&id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUnknownHandle
+		}
+		if err != nil {
+			return nil, err
+		}
+		if id == userID {
+			return nil, ErrBadChallenge
+		}
+		if blocked, err := blockedEither(ctx, s.DB, userID, id); err != nil {
+			return nil, err
+		} else if blocked {
+			return nil, ErrNotEligible
+		}
+		to = &id
+	}
+
+	var startFEN *string
+	if fen != "" {
+		startFEN = &fen
+	}
+	control, _ := json.Marshal(tc)
+	id := uuid.Must(uuid.NewV4()).String()
+	_, err = s.DB.Exec(ctx, `
+INSERT INTO challenges (id, challenger_id, challenged_id, tc, time_control, color, rated, start_fen, min_rating, max_rating, expires_at)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)`,
+		id, userID, to, tc.String(), control, req.Color, req.Rated, startFEN, req.MinRating, req.MaxRating, time.Now().Add(ttl))
+	if err != nil {
+		return nil, err
+	}
+	c, err := scanChallenge(s.DB.QueryRow(ctx, challengeQuery+" WHERE c.id = $1", id))
+	if err != nil {
+		return nil, err
+	}
+	if !seek {
+		if err := notifyChallenge(ctx, s, c.ToID, c.frame()); err != nil {
+			log.Printf("challenge notification error: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// lockOpen loads challenge id for update on behalf of userID. Direct
+// challenges are invisible to anyone but their two players.
+func lockOpen(ctx context.Context, tx pgx.Tx, id, userID string, seek bool) (*Challenge, error) {
+	if _, err := uuid.FromString(id); err != nil {
+		return nil, ErrChallengeNotFound
+	}
+	c, err := scanChallenge(tx.QueryRow(ctx, challengeQuery+" WHERE c.id = $1 FOR UPDATE OF c", id))
+	if err != nil {
+		return nil, err
+	}
+	if c.seek() != seek || (!seek && userID != c.FromID && userID != c.ToID) {
+		return nil, ErrChallengeNotFound
+	}
+	if c.Status != "open" {
+		return nil, ErrChallengeClosed
+	}
+	return c, nil
+}
+
+// AcceptChallenge starts the match of challenge or seek id with userID
+// taking the open seat and returns userID's pairing. Accepting takes both
+// players out of quickplay.
+func AcceptChallenge(ctx context.Context, s *store.Store, userID, id string, seek bool) (*Challenge, *proto.Paired, error) {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	c, err := lockOpen(ctx, tx, id, userID, seek)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rating float64
+	if seek {
+		rating = seekerFor(ctx, s, userID, "").Rating
+	}
+	if err := c.CanAccept(userID, rating); err != nil {
+		return nil, nil, err
+	}
+	if blocked, err := blockedEither(ctx, tx, c.FromID, userID); err != nil {
+		return nil, nil, err
+	} else if blocked {
+		return nil, nil, ErrNotEligible
+	}
+	if _, err := tx.Exec(ctx, "UPDATE challenges SET status = 'accepted', challenged_id = $2 WHERE id = $1", c.ID, userID); err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	for _, u := range []string{c.FromID, userID} {
+		if _, err := leaveQueue(ctx, s, u); err != nil {
+			log.Printf("challenge dequeue error: %v", err)
+		}
+	}
+	seats := allocateColors(ctx, s.DB, c.FromID, userID, color.Preference(c.Color))
+	mine, err := startMatch(ctx, s, newMatch{
+		White: seats.White, Black: seats.Black, TC: c.control, Rated: c.Rated, StartFEN: c.FEN, ColorReason: seats.Reason,
+	}, userID)
+	if err != nil {
+		// Reopen it so a failed start does not use the challenge up.
+		if _, rerr := s.DB.Exec(ctx, "UPDATE challenges SET status = 'open', challenged_id = $2 WHERE id = $1 AND status = 'accepted'", c.ID, nullIfEmpty(c.ToID)); rerr != nil {
+			log.Printf("challenge reopen error: %v", rerr)
+		}
+		return nil, nil, err
+	}
+	if _, err := s.DB.Exec(ctx, "UPDATE challenges SET match_id = $2 WHERE id = $1", c.ID, mine.MatchID); err != nil {
+		log.Printf("challenge update error: %v", err)
+	}
+	c.Status, c.MatchID = "accepted", mine.MatchID
+	return c, mine, nil
+}
+
+// DeclineChallenge turns down a challenge addressed to userID and tells the
+// challenger.
+func DeclineChallenge(ctx context.Context, s *store.Store, userID, id string) error {
+	return closeChallenge(ctx, s, userID, id, false, "declined")
+}
+
+// CancelChallenge withdraws a challenge or seek made by userID.
+func CancelChallenge(ctx context.Context, s *store.Store, userID, id string, seek bool) error {
+	return closeChallenge(ctx, s, userID, id, seek, "cancelled")
+}
+
+// closeChallenge moves an open challenge to status, "declined" by the
+// challenged player or "cancelled" by the challenger, and tells the other.
+func closeChallenge(ctx context.Context, s *store.Store, userID, id string, seek bool, status string) error {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	c, err := lockOpen(ctx, tx, id, userID, seek)
+	if err != nil {
+		return err
+	}
+	actor, other := c.FromID, c.ToID
+	if status == "declined" {
+		actor, other = c.ToID, c.FromID
+	}
+	if userID != actor {
+		return ErrNotEligible
+	}
+	if _, err := tx.Exec(ctx, "UPDATE challenges SET status = $2 WHERE id = $1", c.ID, status); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	if other != "" {
+		c.Status = status
+		if err := notifyChallenge(ctx, s, other, c.frame()); err != nil {
+			log.Printf("challenge notification error: %v", err)
+		}
+	}
+	return nil
+}
+
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func collectChallenges(rows pgx.Rows) ([]*Challenge, error) {
+	defer rows.Close()
+	out := []*Challenge{}
+	for rows.Next() {
+		c, err := scanChallenge(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// writeChallengeError maps challenge errors to HTTP responses.
+func writeChallengeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrChallengeNotFound), errors.Is(err, ErrUnknownHandle):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrChallengeClosed):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrNotEligible):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, clock.ErrBadTimeControl):
+		http.Error(w, "Invalid time control", http.StatusBadRequest)
+	case errors.Is(err, ErrBadChallenge), errors.Is(err, ErrRatedCustomStart):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("challenge error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+	}
+}
+
+// challengeCaller authenticates a challenge request and opens the store.
+func challengeCaller(w http.ResponseWriter, r *http.Request) (string, *store.Store, bool) {
+	userID, err := auth.UserIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", nil, false
+	}
+	s, err := store.New()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return "", nil, false
+	}
+	return userID, s, true
+}
+
+// CreateChallengeHandler challenges the user named by handle.
+func CreateChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	createChallenge(w, r, false)
+}
+
+// CreateSeekHandler posts an open seek to the lobby.
+func CreateSeekHandler(w http.ResponseWriter, r *http.Request) {
+	createChallenge(w, r, true)
+}
+
+func createChallenge(w http.ResponseWriter, r *http.Request, seek bool) {
+	var req ChallengeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TC == "" || (!seek && req.Handle == "") {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	userID, s, ok := challengeCaller(w, r)
+	if !ok {
+		return
+	}
+	c, err := CreateChallenge(r.Context(), s, userID, req, seek)
+	if err != nil {
+		writeChallengeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// ListChallengesHandler lists the caller's open challenges, sent and
+// received.
+func ListChallengesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, s, ok := challengeCaller(w, r)
+	if !ok {
+		return
+	}
+	rows, err := s.DB.Query(r.Context(), challengeQuery+`
+WHERE c.status = 'open' AND c.expires_at > NOW() AND c.challenged_id IS NOT NULL
+  AND (c.challenger_id = $1 OR c.challenged_id = $1)
+ORDER BY c.created_at DESC`, userID)
+	if err != nil {
+		writeChallengeError(w, err)
+		return
+	}
+	list, err := collectChallenges(rows)
+	if err != nil {
+		writeChallengeError(w, err)
+		return
+	}
+	out := map[string][]*Challenge{"incoming": {}, "outgoing": {}}
+	for _, c := range list {
+		if c.FromID == userID {
+			out["outgoing"] = append(out["outgoing"], c)
+		} else {
+			out["incoming"] = append(out["incoming"], c)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ListSeeksHandler lists open seeks the caller could accept, newest first,
+// along with the caller's own.
+func ListSeeksHandler(w http.ResponseWriter, r *http.Request) {
+	userID, s, ok := challengeCaller(w, r)
+	if !ok {
+		return
+	}
+	rating := seekerFor(r.Context(), s, userID, "").Rating
+	rows, err := s.DB.Query(r.Context(), challengeQuery+`
+WHERE c.status = 'open' AND c.expires_at > NOW() AND c.challenged_id IS NULL
+  AND NOT EXISTS (SELECT 1 FROM user_blocks b
+    WHERE (b.blocker_id = c.challenger_id AND b.blocked_id = $1) OR (b.blocker_id = $1 AND b.blocked_id = c.challenger_id))
+  AND (c.challenger_id = $1 OR ((c.min_rating IS NULL OR c.min_rating <= $2) AND (c.max_rating IS NULL OR c.max_rating >= $2)))
+ORDER BY c.created_at DESC LIMIT $3`, userID, rating, maxSeeksListed)
+	if err != nil {
+		writeChallengeError(w, err)
+		return
+	}
+	list, err := collectChallenges(rows)
+	if err != nil {
+		writeChallengeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// AcceptChallengeHandler accepts a challenge sent to the caller and answers
+// with the caller's pairing, as QuickplayHandler does.
+func AcceptChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	acceptChallenge(w, r, false)
+}
+
+// AcceptSeekHandler accepts an open seek from the lobby.
+func AcceptSeekHandler(w http.ResponseWriter, r *http.Request) {
+	acceptChallenge(w, r, true)
+}
+
+func acceptChallenge(w http.ResponseWriter, r *http.Request, seek bool) {
+	userID, s, ok := challengeCaller(w, r)
+	if !ok {
+		return
+	}
+	_, mine, err := AcceptChallenge(r.Context(), s, userID, chi.URLParam(r, "id"), seek)
+	if err != nil {
+		writeChallengeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mine)
+}
+
+// DeclineChallengeHandler turns down a challenge sent to the caller.
+func DeclineChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	userID, s, ok := challengeCaller(w, r)
+	if !ok {
+		return
+	}
+	if err := DeclineChallenge(r.Context(), s, userID, chi.URLParam(r, "id")); err != nil {
+		writeChallengeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CancelChallengeHandler withdraws a challenge the caller sent.
+func CancelChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	cancelChallenge(w, r, false)
+}
+
+// CancelSeekHandler withdraws the caller's seek from the lobby.
+func CancelSeekHandler(w http.ResponseWriter, r *http.Request) {
+	cancelChallenge(w, r, true)
+}
+
+func cancelChallenge(w http.ResponseWriter, r *http.Request, seek bool) {
+	userID, s, ok := challengeCaller(w, r)
+	if !ok {
+		return
+	}
+	if err := CancelChallenge(r.Context(), s, userID, chi.URLParam(r, "id"), seek); err != nil {
+		writeChallengeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
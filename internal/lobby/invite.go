@@ -0,0 +1,329 @@
+package lobby
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+
+	"p2p-chess/internal/clock"
+	"p2p-chess/internal/color"
+	"p2p-chess/internal/proto"
+	"p2p-chess/internal/store"
+)
+
+// An invite is a pending match with the creator seated and the other seat
+// empty until someone opens the invite link. The code is the only secret:
+// inviteCodeLen characters of Crockford base32 carry 50 random bits.
+
+const (
+	InviteTTL     = 24 * time.Hour
+	inviteCodeLen = 10
+)
+
+var inviteEncoding = base32.NewEncoding("0123456789abcdefghjkmnpqrstvwxyz").WithPadding(base32.NoPadding)
+
+var (
+	ErrInviteNotFound = errors.New("invite not found")
+	ErrInviteClosed   = errors.New("invite is no longer valid")
+	ErrOwnInvite      = errors.New("cannot join your own invite")
+)
+
+// InviteRequest sets the terms of an invite, as for a challenge.
+type InviteRequest struct {
+	TC    string `json:"tc"`
+	Color string `json:"color,omitempty"`
+	Rated bool   `json:"rated"`
+	FEN   string `json:"fen,omitempty"`
+}
+
+// Invite is what the creator gets back and what the link shows.
+type Invite struct {
+	Code      string    `json:"code"`
+	MatchID   string    `json:"matchId"`
+	From      string    `json:"from"`
+	TC        string    `json:"tc"`
+	Side      string    `json:"side"`
+	Rated     bool      `json:"rated"`
+	FEN       string    `json:"fen,omitempty"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	creatorID string
+}
+
+func newInviteCode() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return inviteEncoding.EncodeToString(b[:])[:inviteCodeLen]
+}
+
+// CreateInvite seats userID in a new pending match and returns the invite
+// for its other seat. The creator's lapsed invites are aborted on the way.
+func CreateInvite(ctx context.Context, s *store.Store, userID string, req InviteRequest) (*Invite, error) {
+	tc, pref, fen, err := GameTerms(req.TC, req.Color, req.FEN, req.Rated)
+	if err != nil {
+		return nil, err
+	}
+	if err := abortExpiredInvites(ctx, s.DB, userID); err != nil {
+		return nil, err
+	}
+
+	// The guest is unknown yet, so only the creator's history counts.
+	seats := allocateColors(ctx, s.DB, userID, "", color.Preference(pref))
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	nm := newMatch{White: seats.White, Black: seats.Black, TC: tc, Rated: req.Rated, StartFEN: fen, Private: true, ColorReason: seats.Reason}
+	matchID, err := insertMatch(ctx, tx, nm, "pending")
+	if err != nil {
+		return nil, err
+	}
+	code := newInviteCode()
+	if _, err := tx.Exec(ctx, "INSERT INTO match_invites (code, match_id, created_by, expires_at) VALUES ($1,$2,$3,$4)",
+		code, matchID, userID, time.Now().Add(InviteTTL)); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	// A pairing left over from an earlier game must not be mistaken for
+	// this one's while the creator polls.
+	if err := s.Redis.Del(ctx, pairedKey(userID)).Err(); err != nil {
+		log.Printf("invite error: %v", err)
+	}
+	return loadInvite(ctx, s.DB, code)
+}
+
+// abortExpiredInvites aborts the matches of lapsed invites nobody joined,
+// those of createdBy only unless it is empty.
+func abortExpiredInvites(ctx context.Context, q store.DBTX, createdBy string) error {
+	_, err := q.Exec(ctx, `
+UPDATE matches SET status = 'aborted', reason = 'invite expired'
+WHERE status = 'pending' AND id IN (
+  SELECT match_id FROM match_invites WHERE expires_at <= NOW() AND ($1 = '' OR created_by::text = $1))`, createdBy)
+	return err
+}
+
+// InviteStatus is what an invite reads as at now: revoked or used once that
+// happened, expired past expiresAt, closed when its match stopped pending
+// some other way and open otherwise.
+func InviteStatus(revoked, used bool, matchStatus string, expiresAt, now time.Time) string {
+	switch {
+	case revoked:
+		return "revoked"
+	case used:
+		return "used"
+	case !expiresAt.After(now):
+		return "expired"
+	case matchStatus != "pending":
+		return "closed"
+	}
+	return "open"
+}
+
+const inviteQuery = `
+SELECT i.code, i.match_id::text, i.created_by::text, u.handle, m.time_control,
+  CASE WHEN m.side_white = i.created_by THEN 'w' ELSE 'b' END, m.rated, COALESCE(m.start_fen, ''),
+  i.revoked_at IS NOT NULL, i.used_by IS NOT NULL, m.status, i.expires_at
+FROM match_invites i JOIN matches m ON m.id = i.match_id JOIN users u ON u.id = i.created_by
+WHERE i.code = $1`
+
+func loadInvite(ctx context.Context, q store.DBTX, code string) (*Invite, error) {
+	inv := &Invite{}
+	var control []byte
+	var revoked, used bool
+	var matchStatus string
+	err := q.QueryRow(ctx, inviteQuery, code).Scan(&inv.Code, &inv.MatchID, &inv.creatorID, &inv.From, &control,
+		&inv.Side, &inv.Rated, &inv.FEN, &revoked, &used, &matchStatus, &inv.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	inv.Status = InviteStatus(revoked, used, matchStatus, inv.ExpiresAt, time.Now())
+	var tc clock.TimeControl
+	if err := json.Unmarshal(control, &tc); err != nil {
+		return nil, err
+	}
+	inv.TC = tc.String()
+	return inv, nil
+}
+
+// JoinInvite gives userID the open seat of invite code and starts its
+// match, handing both players their pairing. It returns userID's.
+func JoinInvite(ctx context.Context, s *store.Store, userID, code string) (*proto.Paired, error) {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	inv, err := loadInvite(ctx, tx, code)
+	if err != nil {
+		return nil, err
+	}
+	matchID, creator := inv.MatchID, inv.creatorID
+	if inv.Status != "open" {
+		return nil, ErrInviteClosed
+	}
+	if userID == creator {
+		return nil, ErrOwnInvite
+	}
+	if blocked, err := blockedEither(ctx, tx, creator, userID); err != nil {
+		return nil, err
+	} else if blocked {
+		return nil, ErrNotEligible
+	}
+
+	white, black := creator, userID
+	seat := "side_black"
+	if inv.Side == "b" {
+		white, black, seat = userID, creator, "side_white"
+	}
+	// Whoever updates the row first wins; a concurrent join or revoke finds
+	// it no longer pending.
+	tag, err := tx.Exec(ctx, "UPDATE matches SET "+seat+" = $2, status = 'live', started_at = NOW() WHERE id = $1 AND status = 'pending'", matchID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, ErrInviteClosed
+	}
+	if _, err := tx.Exec(ctx, "UPDATE match_invites SET used_by = $2, used_at = NOW() WHERE code = $1", code, userID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	for _, u := range []string{white, black} {
+		if _, err := leaveQueue(ctx, s, u); err != nil {
+			log.Printf("invite dequeue error: %v", err)
+		}
+	}
+	mine, err := seatPlayers(ctx, s, matchID, white, black, userID)
+	if err != nil {
+		abortUnseated(ctx, s, matchID)
+		return nil, err
+	}
+	return mine, nil
+}
+
+// RevokeInvite withdraws an unused invite of userID and aborts its match.
+func RevokeInvite(ctx context.Context, s *store.Store, userID, code string) error {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var matchID string
+	err = tx.QueryRow(ctx, "SELECT match_id::text FROM match_invites WHERE code = $1 AND created_by = $2 FOR UPDATE", code, userID).Scan(&matchID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrInviteNotFound
+	}
+	if err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx, "UPDATE matches SET status = 'aborted', reason = 'invite revoked' WHERE id = $1 AND status = 'pending'", matchID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInviteClosed
+	}
+	if _, err := tx.Exec(ctx, "UPDATE match_invites SET revoked_at = NOW() WHERE code = $1", code); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func writeInviteError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInviteNotFound):
+		http.Error(w, "Invite not found", http.StatusNotFound)
+	case errors.Is(err, ErrInviteClosed):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.Is(err, ErrOwnInvite):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeChallengeError(w, err)
+	}
+}
+
+// CreateInviteHandler opens a private game and answers with its invite
+// code; the creator's pairing arrives like quickplay's once someone joins.
+func CreateInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var req InviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TC == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	userID, s, ok := challengeCaller(w, r)
+	if !ok {
+		return
+	}
+	inv, err := CreateInvite(r.Context(), s, userID, req)
+	if err != nil {
+		writeInviteError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(inv)
+}
+
+// InviteHandler shows what an invite link offers before joining it.
+func InviteHandler(w http.ResponseWriter, r *http.Request) {
+	_, s, ok := challengeCaller(w, r)
+	if !ok {
+		return
+	}
+	inv, err := loadInvite(r.Context(), s.DB, chi.URLParam(r, "code"))
+	if err != nil {
+		writeInviteError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inv)
+}
+
+// JoinInviteHandler takes the open seat of an invite for the caller and
+// answers with their pairing.
+func JoinInviteHandler(w http.ResponseWriter, r *http.Request) {
+	userID, s, ok := challengeCaller(w, r)
+	if !ok {
+		return
+	}
+	mine, err := JoinInvite(r.Context(), s, userID, chi.URLParam(r, "code"))
+	if err != nil {
+		writeInviteError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mine)
+}
+
+// RevokeInviteHandler lets the creator withdraw an invite nobody used yet.
+func RevokeInviteHandler(w http.ResponseWriter, r *http.Request) {
+	userID, s, ok := challengeCaller(w, r)
+	if !ok {
+		return
+	}
+	if err := RevokeInvite(r.Context(), s, userID, chi.URLParam(r, "code")); err != nil {
+		writeInviteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
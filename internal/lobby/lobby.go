@@ -3,215 +3,257 @@ package lobby
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
 
 	"p2p-chess/internal/auth"
+	"p2p-chess/internal/clock"
+	"p2p-chess/internal/color"
+	"p2p-chess/internal/matchkey"
+	"p2p-chess/internal/proto"
+	"p2p-chess/internal/referee"
+	"p2p-chess/internal/signaling"
 	"p2p-chess/internal/store"
 
-	"crypto/rand"
 	"encoding/base64"
 	"time"
 
 	"crypto/hmac"
 	"crypto/sha1"
 
-	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/v5"
 	"github.com/gofrs/uuid"
-	"github.com/redis/go-redis/v9"
 )
 
-func queueKeys(tc string, rated bool) (string, string) {
-	return fmt.Sprintf("lobby:q:%s:%t", tc, rated), fmt.Sprintf("lobby:m:%s:%t", tc, rated)
-}
-
-var enqueueOnceScript = redis.NewScript(`
-local q = KEYS[1]
-local m = KEYS[2]
-local u = ARGV[1]
-if redis.call('SISMEMBER', m, u) == 1 then
-  return 0
-end
-redis.call('SADD', m, u)
-redis.call('RPUSH', q, u)
-return 1
-`)
-
-func EnqueueQuickplay(s *store.Store, userID string, tc string, rated bool) (bool, error) {
-	q, m := queueKeys(tc, rated)
-	n, err := enqueueOnceScript.Run(context.Background(), s.Redis, []string{q, m}, userID).Int()
-	return n == 1, err
-}
-
-var ErrNoPair = errors.New("no pair")
-
-var popTwoDistinctScript = redis.NewScript(`
-local q = KEYS[1]
-local m = KEYS[2]
-if redis.call('LLEN', q) < 2 then
-  return {}
-end
-local a = redis.call('LPOP', q)
-local b = redis.call('LPOP', q)
-if a == b then
-  -- put one back and wait for someone else
-  redis.call('LPUSH', q, a)
-  return {}
-end
-redis.call('SREM', m, a)
-redis.call('SREM', m, b)
-return {a, b}
-`)
-
-func PairUsers(s *store.Store, tc string, rated bool) (string, string, error) {
-	q, m := queueKeys(tc, rated)
-	res, err := popTwoDistinctScript.Run(context.Background(), s.Redis, []string{q, m}).Result()
-	if err != nil {
-		return "", "", err
-	}
-
-	arr, _ := res.([]interface{})
-	if len(arr) < 2 {
-		return "", "", ErrNoPair
-	}
-
-	w := arr[0].(string)
-	b := arr[1].(string)
-
-	// Validate both are valid UUIDs
-	if _, err := uuid.FromString(w); err != nil {
-		return "", "", fmt.Errorf("invalid white uuid: %w", err)
-	}
-	if _, err := uuid.FromString(b); err != nil {
-		return "", "", fmt.Errorf("invalid black uuid: %w", err)
-	}
-
-	return w, b, nil
+// PresetsHandler lists the named time controls quickplay accepts in place
+// of a spec.
+func PresetsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clock.Presets)
 }
 
+// QuickplayRequest names a time control preset or spec, see clock.Lookup.
 type QuickplayRequest struct {
 	TC    string `json:"tc"`
 	Rated bool   `json:"rated"`
 }
 
-func userIDFromAuth(r *http.Request) (string, error) {
-	h := r.Header.Get("Authorization")
-	log.Printf("Authorization header: %s", h)
-
-	if !strings.HasPrefix(h, "Bearer ") {
-		log.Printf("Auth error: missing Bearer prefix")
-		return "", errors.New("no bearer")
-	}
-	raw := strings.TrimPrefix(h, "Bearer ")
-
-	// Log the first few characters of the token for debugging
-	if len(raw) > 10 {
-		log.Printf("Token prefix: %s...", raw[:10])
-	}
-
-	tok, err := auth.ValidateToken(raw)
-	if err != nil {
-		log.Printf("Token validation error: %T %v", err, err)
-		return "", err
-	}
-
-	sub := tok.Subject()
-	log.Printf("Token subject: %q", sub)
-
-	if sub == "" {
-		log.Printf("Auth error: empty subject")
-		return "", errors.New("no sub")
-	}
-	return sub, nil
-}
-
+// QuickplayHandler queues the caller in the pool for the requested time
+// control and runs a pairing pass right away. It answers with the pairing
+// when one was made, otherwise 202 and the pairing arrives through
+// EventsHandler or QueueStatusHandler once the worker finds an opponent.
 func QuickplayHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("QuickplayHandler called with method: %s", r.Method)
-
 	var req QuickplayRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TC == "" {
-		log.Printf("Request decode error or empty TC: %v", err)
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Request data: tc=%s rated=%t", req.TC, req.Rated)
-	log.Printf("Raw Authorization header: %q", r.Header.Get("Authorization"))
+	tc, err := clock.Lookup(req.TC)
+	if err != nil {
+		http.Error(w, "Invalid time control", http.StatusBadRequest)
+		return
+	}
+	// Queue on the canonical spelling so "15|10" meets "15+10".
+	req.TC = tc.String()
 
-	userID, err := userIDFromAuth(r)
+	userID, err := auth.UserIDFromRequest(r)
 	if err != nil {
-		log.Printf("Authentication error: %v", err)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	log.Printf("Authenticated user ID: %s", userID)
-
 	s, err := store.New()
 	if err != nil {
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
 
-	_, err = EnqueueQuickplay(s, userID, req.TC, req.Rated)
-	if err != nil {
+	ctx := r.Context()
+	pool := poolID(req.TC, req.Rated)
+	// A user waits in one pool at a time: asking for another moves them.
+	if _, err := joinQueue(ctx, s, seekerFor(ctx, s, userID, clientIP(r)), req.TC, req.Rated); err != nil {
 		log.Printf("enqueue error: %v", err)
 		http.Error(w, "Queue error", http.StatusInternalServerError)
 		return
 	}
+	if err := pairPool(ctx, s, pool); err != nil {
+		log.Printf("pairing error: %v", err)
+	}
 
-	white, black, err := PairUsers(s, req.TC, req.Rated)
+	frame, err := s.Redis.Get(ctx, pairedKey(userID)).Bytes()
 	if err != nil {
-		if errors.Is(err, ErrNoPair) {
-			w.WriteHeader(http.StatusAccepted)
-			_ = json.NewEncoder(w).Encode(map[string]any{"queued": true})
-			return
-		}
-		http.Error(w, "Queue error", http.StatusInternalServerError)
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]any{"queued": true})
 		return
 	}
+	var mine proto.Paired
+	_ = json.Unmarshal(frame, &mine)
+	_ = json.NewEncoder(w).Encode(mine)
+}
+
+// newMatch describes a match about to be created. StartFEN is empty for the
+// standard starting position; a pending match leaves one seat empty. Private
+// matches are hidden from spectators.
+type newMatch struct {
+	White, Black string
+	TC           clock.TimeControl
+	Rated        bool
+	StartFEN     string
+	Private      bool
+	ColorReason  color.Reason
+}
 
+// startMatch creates a live match and tells both players, returning the
+// pairing handed to userID (nil if userID is not seated). Quickplay pairings
+// and accepted challenges both start their matches here. A match whose
+// players cannot be seated is aborted rather than left live.
+func startMatch(ctx context.Context, s *store.Store, nm newMatch, userID string) (*proto.Paired, error) {
+	matchID, err := insertMatch(ctx, s.DB, nm, "live")
+	if err != nil {
+		return nil, err
+	}
+	mine, err := seatPlayers(ctx, s, matchID, nm.White, nm.Black, userID)
+	if err != nil {
+		abortUnseated(ctx, s, matchID)
+		return nil, err
+	}
+	return mine, nil
+}
+
+// abortUnseated aborts a live match whose players could not be seated, so
+// it does not linger with nobody able to join it.
+func abortUnseated(ctx context.Context, s *store.Store, matchID string) {
+	if _, err := s.DB.Exec(ctx, "UPDATE matches SET status = 'aborted', reason = 'unseated' WHERE id = $1 AND status = 'live'", matchID); err != nil {
+		log.Printf("match abort error: %v", err)
+	}
+}
+
+// insertMatch stores nm with both clocks at the first period's base.
+func insertMatch(ctx context.Context, q store.DBTX, nm newMatch, status string) (string, error) {
 	matchID := uuid.Must(uuid.NewV4()).String()
-	baseMs, incMs, delayMs := 300000, 3000, 0
+	first := nm.TC.Periods[0]
+	baseMs, incMs, delayMs := first.BaseMs, first.IncMs, first.DelayMs
+	control, _ := json.Marshal(nm.TC)
 	msWhite, msBlack := baseMs, baseMs
 
-	_, err = s.DB.Exec(r.Context(), `
-INSERT INTO matches (id, side_white, side_black, tc_base_ms, tc_inc_ms, tc_delay_ms, status, side_to_move, last_fen, ms_white, ms_black, rated)
-VALUES ($1,$2,$3,$4,$5,$6,'live','w','rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1',$7,$8,$9)`,
-		matchID, white, black, baseMs, incMs, delayMs, msWhite, msBlack, req.Rated)
+	fen, side := referee.StartFEN, "w"
+	var startFEN *string
+	if nm.StartFEN != "" {
+		fen, startFEN = nm.StartFEN, &nm.StartFEN
+		if f := strings.Fields(fen); len(f) > 1 {
+			side = f[1]
+		}
+	}
+
+	_, err := q.Exec(ctx, `
+INSERT INTO matches (id, side_white, side_black, tc_base_ms, tc_inc_ms, tc_delay_ms, time_control, status, side_to_move, last_fen, start_fen, ms_white, ms_black, rated, private, color_reason)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16)`,
+		matchID, nullIfEmpty(nm.White), nullIfEmpty(nm.Black), baseMs, incMs, delayMs, control, status, side, fen, startFEN, msWhite, msBlack, nm.Rated, nm.Private, nullIfEmpty(string(nm.ColorReason)))
 	if err != nil {
-		log.Printf("db insert error: %v", err)
-		http.Error(w, "DB error", http.StatusInternalServerError)
-		return
+		return "", fmt.Errorf("insert match: %w", err)
 	}
+	return matchID, nil
+}
 
-	matchKey := make([]byte, 32)
-	if _, err := rand.Read(matchKey); err != nil {
-		http.Error(w, "Crypto error", http.StatusInternalServerError)
-		return
+// colorHistory is userID's colours in their last color.HistoryLen matches
+// that got under way, oldest first.
+func colorHistory(ctx context.Context, q store.DBTX, userID string) (string, error) {
+	var h string
+	err := q.QueryRow(ctx, `
+SELECT COALESCE(string_agg(c, '' ORDER BY created_at), '') FROM (
+  SELECT CASE WHEN side_white = $1 THEN 'w' ELSE 'b' END AS c, created_at
+  FROM matches WHERE (side_white = $1 OR side_black = $1) AND status IN ('live', 'relayed', 'finished')
+  ORDER BY created_at DESC LIMIT $2
+) recent`, userID, color.HistoryLen).Scan(&h)
+	return h, err
+}
+
+// allocateColors seats a and b with color.Allocate, a being the player
+// whose preference counts. An empty b stands for an opponent not known yet.
+func allocateColors(ctx context.Context, q store.DBTX, a, b string, pref color.Preference) color.Allocation {
+	players := []color.Player{{ID: a}, {ID: b}}
+	for i := range players {
+		if players[i].ID == "" {
+			continue
+		}
+		h, err := colorHistory(ctx, q, players[i].ID)
+		if err != nil {
+			log.Printf("color history error: %v", err)
+		}
+		players[i].History = h
+	}
+	return color.Allocate(players[0], players[1], pref)
+}
+
+// seatPlayers issues the first match key of matchID and hands each player
+// their pairing: join token, ICE config and the key. It returns the pairing
+// handed to userID, if seated.
+func seatPlayers(ctx context.Context, s *store.Store, matchID, white, black, userID string) (*proto.Paired, error) {
+	matchKey, err := matchkey.Rotate(ctx, s, matchID, 0)
+	if err != nil {
+		return nil, fmt.Errorf("match key: %w", err)
 	}
 	matchKeyStr := base64.StdEncoding.EncodeToString(matchKey)
-	joinToken := uuid.Must(uuid.NewV4()).String()
 
-	turnSecret := os.Getenv("TURN_SECRET")
-	iceCreds := generateTURNCreds(userID, 10*time.Minute, turnSecret)
+	var mine *proto.Paired
+	for _, seat := range []signaling.Seat{
+		{MatchID: matchID, UserID: white, Side: "w"},
+		{MatchID: matchID, UserID: black, Side: "b"},
+	} {
+		p, err := pairedFor(ctx, s, seat, white, black, matchKeyStr)
+		if err != nil {
+			return nil, fmt.Errorf("pairing notification: %w", err)
+		}
+		if err := notifyPaired(ctx, s, seat.UserID, p); err != nil {
+			log.Printf("pairing notification error: %v", err)
+		}
+		if seat.UserID == userID {
+			mine = p
+		}
+	}
+	return mine, nil
+}
+
+// clientIP is the address a request came from, as the rate limiter sees it.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
 
-	_ = json.NewEncoder(w).Encode(map[string]any{
-		"matchId":   matchID,
-		"sides":     map[string]string{"white": white, "black": black},
-		"matchKey":  matchKeyStr,
-		"joinToken": joinToken,
-		"webrtcConfig": map[string]any{
+// pairedFor builds the per-seat half of a pairing: own join token and TURN
+// credentials, shared match key.
+func pairedFor(ctx context.Context, s *store.Store, seat signaling.Seat, white, black, matchKey string) (*proto.Paired, error) {
+	joinToken, err := signaling.IssueJoinToken(ctx, s, seat)
+	if err != nil {
+		return nil, err
+	}
+	color := "white"
+	if seat.Side == "b" {
+		color = "black"
+	}
+	iceCreds := generateTURNCreds(seat.UserID, 10*time.Minute, os.Getenv("TURN_SECRET"))
+	return &proto.Paired{
+		MatchID:   seat.MatchID,
+		Side:      seat.Side,
+		Color:     color,
+		Sides:     map[string]string{"white": white, "black": black},
+		MatchKey:  matchKey,
+		JoinToken: joinToken,
+		WebRTCConfig: map[string]any{
 			"iceServers": []map[string]any{
 				{"urls": "stun:your.stun.server:3478"},
 				{"urls": "turn:your.turn.server:3478", "username": iceCreds["username"], "credential": iceCreds["password"]},
 			},
 		},
-	})
+	}, nil
 }
 
 func ResumeHandler(w http.ResponseWriter, r *http.Request) {
@@ -221,23 +263,41 @@ func ResumeHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
+	// Resuming hands out a fresh matchKey, so only the two players may do it.
+	side, ok := referee.AuthorizeSeat(w, r, s, matchID)
+	if !ok {
+		return
+	}
 	var lastSeq int
 	var lastFen string
 	var msWhite, msBlack int
-	var sideToMove string
-	err = s.DB.QueryRow(r.Context(), "SELECT last_seq, last_fen, ms_white, ms_black, side_to_move FROM matches WHERE id = $1", matchID).Scan(&lastSeq, &lastFen, &msWhite, &msBlack, &sideToMove)
+	var sideToMove, status string
+	err = s.DB.QueryRow(r.Context(), "SELECT last_seq, last_fen, ms_white, ms_black, side_to_move, status FROM matches WHERE id = $1", matchID).Scan(&lastSeq, &lastFen, &msWhite, &msBlack, &sideToMove, &status)
 	if err != nil {
 		http.Error(w, "Match not found", http.StatusNotFound)
 		return
 	}
-	// Optional: Rotate matchKey
-	newMatchKey := make([]byte, 32)
-	_, err = rand.Read(newMatchKey)
+	// A finished or aborted match has nothing to resume, and rotating its key
+	// would only invalidate signatures a dispute may still need.
+	if status != "live" && status != "relayed" {
+		http.Error(w, "Match not in progress", http.StatusConflict)
+		return
+	}
+	// Rotate matchKey; the old one stays valid for a few events so moves
+	// already in flight between the peers still verify.
+	newMatchKey, err := matchkey.Rotate(r.Context(), s, matchID, matchkey.GraceEvents())
 	if err != nil {
-		// handle
+		log.Printf("match key rotation error: %v", err)
+		http.Error(w, "Crypto error", http.StatusInternalServerError)
+		return
 	}
 	newMatchKeyStr := base64.StdEncoding.EncodeToString(newMatchKey)
-	// TODO: Store new key, allow old for N events
+	// The opponent must switch too, or their legacy HMAC signatures stop
+	// verifying once the grace window runs out.
+	frame, _ := proto.Encode(proto.ActionMatchKey, proto.MatchKey{MatchID: matchID, MatchKey: newMatchKeyStr})
+	if err := signaling.Publish(r.Context(), s, matchID, signaling.Opponent(side), frame); err != nil {
+		log.Printf("match key notification error: %v", err)
+	}
 
 	response := map[string]interface{}{
 		"last_seq":     lastSeq,
@@ -0,0 +1,287 @@
+package lobby_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+
+	"p2p-chess/internal/clock"
+	"p2p-chess/internal/lobby"
+	"p2p-chess/internal/referee"
+)
+
+func TestSeekerWindowWidens(t *testing.T) {
+	now := time.Now()
+	k := lobby.Seeker{RD: 60, Since: now}
+	assert.Equal(t, 130.0, k.Window(now))
+	assert.Equal(t, 330.0, k.Window(now.Add(20*time.Second)))
+	assert.Equal(t, 1030.0, k.Window(now.Add(time.Hour)))
+}
+
+func TestPair(t *testing.T) {
+	now := time.Now()
+	ago := func(s int) time.Time { return now.Add(-time.Duration(s) * time.Second) }
+	none := func(a, b string) bool { return false }
+	ids := func(pairs [][2]lobby.Seeker) [][2]string {
+		var out [][2]string
+		for _, p := range pairs {
+			out = append(out, [2]string{p[0].UserID, p[1].UserID})
+		}
+		return out
+	}
+
+	cases := []struct {
+		name    string
+		seekers []lobby.Seeker
+		blocked func(a, b string) bool
+		want    [][2]string
+	}{
+		{
+			name: "far apart and fresh",
+			seekers: []lobby.Seeker{
+				{UserID: "a", Rating: 2400, RD: 50, Since: now},
+				{UserID: "b", Rating: 900, RD: 50, Since: now},
+			},
+			blocked: none,
+		},
+		{
+			name: "far apart after a long wait",
+			seekers: []lobby.Seeker{
+				{UserID: "a", Rating: 2000, RD: 50, Since: ago(120)},
+				{UserID: "b", Rating: 1200, RD: 50, Since: ago(100)},
+			},
+			blocked: none,
+			want:    [][2]string{{"a", "b"}},
+		},
+		{
+			name: "closest rating wins",
+			seekers: []lobby.Seeker{
+				{UserID: "a", Rating: 1500, RD: 50, Since: ago(10)},
+				{UserID: "b", Rating: 1580, RD: 50, Since: ago(5)},
+				{UserID: "c", Rating: 1520, RD: 50, Since: ago(1)},
+			},
+			blocked: none,
+			want:    [][2]string{{"a", "c"}},
+		},
+		{
+			name: "narrower window of the newcomer applies",
+			seekers: []lobby.Seeker{
+				{UserID: "a", Rating: 1500, RD: 50, Since: ago(60)},
+				{UserID: "b", Rating: 1800, RD: 50, Since: now},
+			},
+			blocked: none,
+		},
+		{
+			name: "rating deviation widens the window",
+			seekers: []lobby.Seeker{
+				{UserID: "a", Rating: 1500, RD: 350, Since: ago(60)},
+				{UserID: "b", Rating: 1750, RD: 350, Since: now},
+			},
+			blocked: none,
+			want:    [][2]string{{"a", "b"}},
+		},
+		{
+			name: "shared IP",
+			seekers: []lobby.Seeker{
+				{UserID: "a", Rating: 1500, IP: "10.0.0.1", Since: ago(5)},
+				{UserID: "b", Rating: 1510, IP: "10.0.0.1", Since: now},
+				{UserID: "c", Rating: 1560, IP: "10.0.0.2", Since: now},
+			},
+			blocked: none,
+			want:    [][2]string{{"a", "c"}},
+		},
+		{
+			name: "blocked either way",
+			seekers: []lobby.Seeker{
+				{UserID: "a", Rating: 1500, Since: ago(5)},
+				{UserID: "b", Rating: 1510, Since: ago(4)},
+				{UserID: "c", Rating: 1560, Since: now},
+			},
+			blocked: func(x, y string) bool { return x == "b" && y == "a" },
+			want:    [][2]string{{"a", "c"}},
+		},
+		{
+			name: "everyone paired once",
+			seekers: []lobby.Seeker{
+				{UserID: "a", Rating: 1500, Since: ago(4)},
+				{UserID: "b", Rating: 1510, Since: ago(3)},
+				{UserID: "c", Rating: 1520, Since: ago(2)},
+				{UserID: "d", Rating: 1530, Since: ago(1)},
+			},
+			blocked: none,
+			want:    [][2]string{{"a", "b"}, {"c", "d"}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, ids(lobby.Pair(c.seekers, now, c.blocked)))
+		})
+	}
+}
+
+func TestEstimateWait(t *testing.T) {
+	cases := []struct {
+		name   string
+		recent []time.Duration
+		waited time.Duration
+		want   time.Duration
+		ok     bool
+	}{
+		{"no history", nil, 5 * time.Second, 0, false},
+		{"average less time waited", []time.Duration{10 * time.Second, 20 * time.Second}, 5 * time.Second, 10 * time.Second, true},
+		{"waited past the average", []time.Duration{10 * time.Second}, time.Minute, 0, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := lobby.EstimateWait(c.recent, c.waited)
+			assert.Equal(t, c.ok, ok)
+			assert.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestSweepStale(t *testing.T) {
+	now := time.Now()
+	seen := func(ago time.Duration) float64 { return float64(now.Add(-ago).UnixMilli()) }
+	queue := []redis.Z{
+		{Member: "fresh", Score: seen(0)},
+		{Member: "within the minute", Score: seen(59 * time.Second)},
+		{Member: "exactly a minute", Score: seen(time.Minute)},
+		{Member: "long gone", Score: seen(time.Hour)},
+	}
+
+	cases := []struct {
+		name    string
+		failOn  string
+		want    []string
+		wantErr bool
+	}{
+		{"drops the silent", "", []string{"exactly a minute", "long gone"}, false},
+		{"stops at the first error", "exactly a minute", []string{"exactly a minute"}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var dropped []string
+			err := lobby.SweepStale(queue, now, func(userID string) error {
+				dropped = append(dropped, userID)
+				if userID == c.failOn {
+					return errors.New("redis down")
+				}
+				return nil
+			})
+			assert.Equal(t, c.wantErr, err != nil)
+			assert.Equal(t, c.want, dropped)
+		})
+	}
+}
+
+func TestStartPosition(t *testing.T) {
+	custom := "4k3/8/8/8/8/8/4P3/4K3 w - - 0 1"
+	cases := []struct {
+		name string
+		fen  string
+		want string
+		err  error
+	}{
+		{"none", "", "", nil},
+		{"standard position", referee.StartFEN, "", nil},
+		{"custom position", custom, custom, nil},
+		{"illegal FEN", "not a position", "", lobby.ErrBadChallenge},
+		{"checkmated", "rnb1kbnr/pppp1ppp/8/4p3/6Pq/5P2/PPPPP2P/RNBQKBNR w KQkq - 1 3", "", lobby.ErrBadChallenge},
+		{"stalemated", "7k/5Q2/6K1/8/8/8/8/8 b - - 0 1", "", lobby.ErrBadChallenge},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := lobby.StartPosition(c.fen)
+			assert.ErrorIs(t, err, c.err)
+			assert.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestGameTerms(t *testing.T) {
+	custom := "4k3/8/8/8/8/8/4P3/4K3 w - - 0 1"
+	cases := []struct {
+		name      string
+		tc, color string
+		fen       string
+		rated     bool
+		wantColor string
+		err       error
+	}{
+		{"defaults to random", "3+2", "", "", true, lobby.ColorRandom, nil},
+		{"colour kept", "blitz", lobby.ColorBlack, "", false, lobby.ColorBlack, nil},
+		{"bad colour", "3+2", "green", "", false, "", lobby.ErrBadChallenge},
+		{"bad time control", "3+", "", "", false, "", clock.ErrBadTimeControl},
+		{"casual custom start", "3+2", "", custom, false, lobby.ColorRandom, nil},
+		{"rated custom start", "3+2", "", custom, true, "", lobby.ErrRatedCustomStart},
+		{"rated standard start", "3+2", "", referee.StartFEN, true, lobby.ColorRandom, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, color, _, err := lobby.GameTerms(c.tc, c.color, c.fen, c.rated)
+			assert.ErrorIs(t, err, c.err)
+			assert.Equal(t, c.wantColor, color)
+		})
+	}
+}
+
+func TestCanAccept(t *testing.T) {
+	lo, hi := 1400, 1600
+	direct := &lobby.Challenge{FromID: "a", ToID: "b"}
+	seek := &lobby.Challenge{FromID: "a", MinRating: &lo, MaxRating: &hi}
+	open := &lobby.Challenge{FromID: "a"}
+	cases := []struct {
+		name   string
+		c      *lobby.Challenge
+		user   string
+		rating float64
+		err    error
+	}{
+		{"recipient", direct, "b", 0, nil},
+		{"wrong recipient", direct, "c", 1500, lobby.ErrNotEligible},
+		{"challenger of a direct challenge", direct, "a", 1500, lobby.ErrNotEligible},
+		{"within bounds", seek, "c", 1500, nil},
+		{"on the bounds", seek, "c", 1600, nil},
+		{"below bounds", seek, "c", 1399, lobby.ErrNotEligible},
+		{"above bounds", seek, "c", 1601, lobby.ErrNotEligible},
+		{"own seek", seek, "a", 1500, lobby.ErrBadChallenge},
+		{"unbounded seek", open, "c", 3000, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.ErrorIs(t, c.c.CanAccept(c.user, c.rating), c.err)
+		})
+	}
+}
+
+func TestInviteStatus(t *testing.T) {
+	now := time.Now()
+	later, earlier := now.Add(time.Hour), now.Add(-time.Hour)
+	cases := []struct {
+		name        string
+		revoked     bool
+		used        bool
+		matchStatus string
+		expiresAt   time.Time
+		want        string
+	}{
+		{"open", false, false, "pending", later, "open"},
+		{"expired", false, false, "pending", earlier, "expired"},
+		{"expires right now", false, false, "pending", now, "expired"},
+		{"revoked", true, false, "aborted", later, "revoked"},
+		{"revoked after expiry", true, false, "aborted", earlier, "revoked"},
+		{"used", false, true, "live", later, "used"},
+		{"used game finished after expiry", false, true, "finished", earlier, "used"},
+		{"match aborted by the sweep", false, false, "aborted", earlier, "expired"},
+		{"match aborted before expiry", false, false, "aborted", later, "closed"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, lobby.InviteStatus(c.revoked, c.used, c.matchStatus, c.expiresAt, now))
+		})
+	}
+}
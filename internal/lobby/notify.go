@@ -0,0 +1,183 @@
+package lobby
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"p2p-chess/internal/auth"
+	"p2p-chess/internal/proto"
+	"p2p-chess/internal/store"
+)
+
+// PairedTTL is how long a pairing stays retrievable through the status
+// endpoint; it matches the lifetime of the TURN credentials it carries.
+const PairedTTL = 10 * time.Minute
+
+const eventsKeepAlive = 25 * time.Second
+
+func userChannel(userID string) string {
+	return "lobby:user:" + userID
+}
+
+func pairedKey(userID string) string {
+	return "lobby:paired:" + userID
+}
+
+func waitingKey(userID string) string {
+	return "lobby:waiting:" + userID
+}
+
+type waiting struct {
+	TC    string `json:"tc"`
+	Rated bool   `json:"rated"`
+}
+
+// notifyPaired stores p for polling and pushes it to any open event stream
+// of userID.
+func notifyPaired(ctx context.Context, s *store.Store, userID string, p *proto.Paired) error {
+	frame, err := proto.Encode(proto.ActionPaired, p)
+	if err != nil {
+		return err
+	}
+	_, err = s.Redis.TxPipelined(ctx, func(pl redis.Pipeliner) error {
+		pl.Del(ctx, waitingKey(userID))
+		pl.Set(ctx, pairedKey(userID), frame, PairedTTL)
+		pl.Publish(ctx, userChannel(userID), frame)
+		return nil
+	})
+	return err
+}
+
+// notifyChallenge pushes c to any open event stream of userID. Unlike a
+// pairing it is not kept for polling; ListChallengesHandler serves that.
+func notifyChallenge(ctx context.Context, s *store.Store, userID string, c *proto.Challenge) error {
+	frame, err := proto.Encode(proto.ActionChallenge, c)
+	if err != nil {
+		return err
+	}
+	return s.Redis.Publish(ctx, userChannel(userID), frame).Err()
+}
+
+// EventsHandler streams lobby notifications ("paired" and "challenge") to the
+// caller as server-sent events. An open stream keeps a queued caller's entry
+// alive. EventSource cannot set headers, so the JWT may also be passed as
+// ?token=. Streams are long-lived, so they share the server's store rather
+// than opening their own.
+func EventsHandler(s *store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := auth.UserIDFromRequest(r)
+		if err != nil {
+			tok, verr := auth.ValidateToken(r.URL.Query().Get("token"))
+			if verr != nil || tok.Subject() == "" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			userID = tok.Subject()
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		ctx := r.Context()
+		sub := s.Redis.Subscribe(ctx, userChannel(userID))
+		defer sub.Close()
+		if _, err := sub.Receive(ctx); err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		// A pairing that happened before we subscribed would otherwise be missed.
+		if frame, err := s.Redis.Get(ctx, pairedKey(userID)).Bytes(); err == nil {
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", proto.ActionPaired, frame)
+		}
+		flusher.Flush()
+		touchSeeker(ctx, s, userID)
+
+		ticker := time.NewTicker(eventsKeepAlive)
+		defer ticker.Stop()
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				touchSeeker(ctx, s, userID)
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				var env proto.Envelope
+				_ = json.Unmarshal([]byte(msg.Payload), &env)
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", env.Action, msg.Payload)
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// QueueStatusHandler is the polling fallback for EventsHandler: it reports
+// whether the caller is idle, still queued (with position and estimated
+// wait), or already paired. Polling keeps a queued caller's entry alive.
+func QueueStatusHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.UserIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s, err := store.New()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	frame, err := s.Redis.Get(r.Context(), pairedKey(userID)).Bytes()
+	if err == nil {
+		var p proto.Paired
+		_ = json.Unmarshal(frame, &p)
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": "paired", "match": p})
+		return
+	}
+	if !errors.Is(err, redis.Nil) {
+		log.Printf("queue status error: %v", err)
+		http.Error(w, "Queue error", http.StatusInternalServerError)
+		return
+	}
+
+	b, err := s.Redis.Get(r.Context(), waitingKey(userID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": "idle"})
+		return
+	}
+	if err != nil {
+		log.Printf("queue status error: %v", err)
+		http.Error(w, "Queue error", http.StatusInternalServerError)
+		return
+	}
+	var q waiting
+	_ = json.Unmarshal(b, &q)
+	touchSeeker(r.Context(), s, userID)
+	status, err := queueStatus(r.Context(), s, poolID(q.TC, q.Rated), userID)
+	if err != nil {
+		log.Printf("queue status error: %v", err)
+		status = map[string]any{}
+	}
+	status["status"], status["tc"], status["rated"] = "queued", q.TC, q.Rated
+	_ = json.NewEncoder(w).Encode(status)
+}
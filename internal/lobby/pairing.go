@@ -0,0 +1,293 @@
+package lobby
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"p2p-chess/internal/clock"
+	"p2p-chess/internal/store"
+)
+
+// Each quickplay pool (time control, rated) is a sorted set of waiting user
+// IDs scored by rating, with the rest of each Seeker in a hash beside it.
+// poolsKey lists the pools the pairing worker has to visit.
+const poolsKey = "lobby:pools"
+
+func poolID(tc string, rated bool) string {
+	return fmt.Sprintf("%s:%t", tc, rated)
+}
+
+// parsePool splits a pool ID back into its time control and rated flag.
+func parsePool(pool string) (string, bool) {
+	i := strings.LastIndex(pool, ":")
+	if i < 0 {
+		return pool, false
+	}
+	rated, _ := strconv.ParseBool(pool[i+1:])
+	return pool[:i], rated
+}
+
+func poolKey(pool string) string {
+	return "lobby:pool:" + pool
+}
+
+func poolInfoKey(pool string) string {
+	return "lobby:pool:" + pool + ":info"
+}
+
+// The acceptable rating gap starts at baseWindow, widens by widenPerSecond
+// of waiting up to maxWindow, and is stretched by half the seeker's rating
+// deviation so provisional ratings match more loosely.
+const (
+	baseWindow     = 100.0
+	widenPerSecond = 10.0
+	maxWindow      = 1000.0
+	pairInterval   = time.Second
+	// inviteSweep is how often the worker aborts lapsed invites' matches.
+	inviteSweep = time.Minute
+)
+
+// Seeker is a user waiting in a pool.
+type Seeker struct {
+	UserID string    `json:"-"`
+	Rating float64   `json:"-"`
+	RD     float64   `json:"rd"`
+	IP     string    `json:"ip"`
+	Since  time.Time `json:"since"`
+}
+
+// Window is the largest rating gap s accepts at now.
+func (s Seeker) Window(now time.Time) float64 {
+	waited := max(now.Sub(s.Since).Seconds(), 0)
+	return min(baseWindow+widenPerSecond*waited, maxWindow) + s.RD/2
+}
+
+// Pair matches seekers, longest waiting first, each with the closest-rated
+// seeker both sides' windows accept. Players who share an IP, or where
+// blocked(blocker, blockee) holds either way round, are never paired. The
+// first seeker of each pair is the one who waited longer; colours are left
+// to color.Allocate.
+func Pair(seekers []Seeker, now time.Time, blocked func(a, b string) bool) [][2]Seeker {
+	order := append([]Seeker(nil), seekers...)
+	sort.SliceStable(order, func(i, j int) bool { return order[i].Since.Before(order[j].Since) })
+
+	taken := make([]bool, len(order))
+	var pairs [][2]Seeker
+	for i, a := range order {
+		if taken[i] {
+			continue
+		}
+		best, bestGap := -1, math.Inf(1)
+		for j := i + 1; j < len(order); j++ {
+			b := order[j]
+			if taken[j] || a.UserID == b.UserID || (a.IP != "" && a.IP == b.IP) {
+				continue
+			}
+			gap := math.Abs(a.Rating - b.Rating)
+			if gap > min(a.Window(now), b.Window(now)) || gap >= bestGap {
+				continue
+			}
+			if blocked(a.UserID, b.UserID) || blocked(b.UserID, a.UserID) {
+				continue
+			}
+			best, bestGap = j, gap
+		}
+		if best >= 0 {
+			taken[i], taken[best] = true, true
+			pairs = append(pairs, [2]Seeker{a, order[best]})
+		}
+	}
+	return pairs
+}
+
+var enqueueScript = redis.NewScript(`
+redis.call('ZADD', KEYS[4], ARGV[5], ARGV[1])
+if redis.call('ZADD', KEYS[1], 'NX', ARGV[2], ARGV[1]) == 0 then
+  return 0
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+redis.call('SADD', KEYS[3], ARGV[4])
+return 1
+`)
+
+// EnqueueQuickplay adds k to pool unless it is already waiting there, and
+// counts as a heartbeat either way.
+func EnqueueQuickplay(ctx context.Context, s *store.Store, pool string, k Seeker) (bool, error) {
+	info, _ := json.Marshal(k)
+	n, err := enqueueScript.Run(ctx, s.Redis, []string{poolKey(pool), poolInfoKey(pool), poolsKey, seenKey},
+		k.UserID, k.Rating, info, pool, time.Now().UnixMilli()).Int()
+	return n == 1, err
+}
+
+// claimScript takes both users out of the pool, or neither if one already
+// left or was paired by another worker.
+var claimScript = redis.NewScript(`
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) == false or redis.call('ZSCORE', KEYS[1], ARGV[2]) == false then
+  return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1], ARGV[2])
+redis.call('HDEL', KEYS[2], ARGV[1], ARGV[2])
+redis.call('ZREM', KEYS[3], ARGV[1], ARGV[2])
+return 1
+`)
+
+// retireScript drops an empty pool from the worker's list.
+var retireScript = redis.NewScript(`
+if redis.call('ZCARD', KEYS[1]) == 0 then
+  redis.call('SREM', KEYS[2], ARGV[1])
+end
+return 0
+`)
+
+// seekerFor looks up userID's rating; unrated players start at 1500 with
+// the maximum deviation.
+func seekerFor(ctx context.Context, s *store.Store, userID, ip string) Seeker {
+	k := Seeker{UserID: userID, Rating: 1500, RD: 350, IP: ip, Since: time.Now()}
+	var rating, rd *float64
+	if err := s.DB.QueryRow(ctx, "SELECT rating, rd FROM ratings WHERE user_id = $1", userID).Scan(&rating, &rd); err == nil {
+		if rating != nil {
+			k.Rating = *rating
+		}
+		if rd != nil {
+			k.RD = *rd
+		}
+	}
+	return k
+}
+
+// loadPool reads every seeker waiting in pool.
+func loadPool(ctx context.Context, s *store.Store, pool string) ([]Seeker, error) {
+	members, err := s.Redis.ZRangeWithScores(ctx, poolKey(pool), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.Redis.HGetAll(ctx, poolInfoKey(pool)).Result()
+	if err != nil {
+		return nil, err
+	}
+	seekers := make([]Seeker, 0, len(members))
+	for _, m := range members {
+		k := Seeker{UserID: m.Member.(string), Rating: m.Score}
+		_ = json.Unmarshal([]byte(info[k.UserID]), &k)
+		seekers = append(seekers, k)
+	}
+	return seekers, nil
+}
+
+// blocksAmong returns whether one of ids has blocked another.
+func blocksAmong(ctx context.Context, s *store.Store, ids []string) (func(a, b string) bool, error) {
+	rows, err := s.DB.Query(ctx, "SELECT blocker_id::text, blocked_id::text FROM user_blocks WHERE blocker_id::text = ANY($1) AND blocked_id::text = ANY($1)", ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	set := map[[2]string]bool{}
+	for rows.Next() {
+		var a, b string
+		if err := rows.Scan(&a, &b); err != nil {
+			return nil, err
+		}
+		set[[2]string{a, b}] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return func(a, b string) bool { return set[[2]string{a, b}] }, nil
+}
+
+// pairPool runs one pairing pass over pool and starts a match for every
+// pair it can claim.
+func pairPool(ctx context.Context, s *store.Store, pool string) error {
+	seekers, err := loadPool(ctx, s, pool)
+	if err != nil {
+		return err
+	}
+	if len(seekers) == 0 {
+		return retireScript.Run(ctx, s.Redis, []string{poolKey(pool), poolsKey}, pool).Err()
+	}
+	if len(seekers) < 2 {
+		return nil
+	}
+	ids := make([]string, len(seekers))
+	for i, k := range seekers {
+		ids[i] = k.UserID
+	}
+	blocked, err := blocksAmong(ctx, s, ids)
+	if err != nil {
+		return err
+	}
+
+	spec, rated := parsePool(pool)
+	tc, err := clock.Parse(spec)
+	if err != nil {
+		return err
+	}
+	for _, p := range Pair(seekers, time.Now(), blocked) {
+		n, err := claimScript.Run(ctx, s.Redis, []string{poolKey(pool), poolInfoKey(pool), seenKey}, p[0].UserID, p[1].UserID).Int()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		seats := allocateColors(ctx, s.DB, p[0].UserID, p[1].UserID, "")
+		nm := newMatch{White: seats.White, Black: seats.Black, TC: tc, Rated: rated, ColorReason: seats.Reason}
+		if _, err := startMatch(ctx, s, nm, ""); err != nil {
+			log.Printf("pairing: start match: %v", err)
+			// Put both back so they are not stranded.
+			for _, k := range p {
+				if _, err := EnqueueQuickplay(ctx, s, pool, k); err != nil {
+					log.Printf("pairing: requeue: %v", err)
+				}
+			}
+			continue
+		}
+		recordWaits(ctx, s, pool, p[:])
+	}
+	return nil
+}
+
+// RunPairing pairs waiting players in every pool until ctx is done, first
+// dropping seekers whose heartbeat lapsed. Every inviteSweep it also aborts
+// the pending matches of expired invites. Several instances may run it;
+// claims keep a user from being paired twice.
+func RunPairing(ctx context.Context, s *store.Store) {
+	ticker := time.NewTicker(pairInterval)
+	defer ticker.Stop()
+	var swept time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := expireStale(ctx, s, time.Now()); err != nil {
+			log.Printf("pairing: expire: %v", err)
+		}
+		if time.Since(swept) >= inviteSweep {
+			if err := abortExpiredInvites(ctx, s.DB, ""); err != nil {
+				log.Printf("pairing: invite sweep: %v", err)
+			}
+			swept = time.Now()
+		}
+		pools, err := s.Redis.SMembers(ctx, poolsKey).Result()
+		if err != nil {
+			log.Printf("pairing: %v", err)
+			continue
+		}
+		for _, pool := range pools {
+			if err := pairPool(ctx, s, pool); err != nil {
+				log.Printf("pairing: pool %s: %v", pool, err)
+			}
+		}
+	}
+}
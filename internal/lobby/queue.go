@@ -0,0 +1,252 @@
+package lobby
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"p2p-chess/internal/auth"
+	"p2p-chess/internal/store"
+)
+
+// seenKey scores every queued user by their last heartbeat (unix ms). A
+// quickplay request, a status poll or an open event stream counts as one;
+// seekers silent for longer than queueStaleAfter are dropped.
+const (
+	seenKey         = "lobby:seen"
+	queueStaleAfter = time.Minute
+	recentWaits     = 50
+)
+
+// poolWaitsKey holds how long the latest pairings in pool waited, in ms.
+func poolWaitsKey(pool string) string {
+	return "lobby:pool:" + pool + ":waits"
+}
+
+// currentPool is the pool userID is waiting in, if any.
+func currentPool(ctx context.Context, s *store.Store, userID string) (string, bool, error) {
+	b, err := s.Redis.Get(ctx, waitingKey(userID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	var q waiting
+	if err := json.Unmarshal(b, &q); err != nil {
+		return "", false, err
+	}
+	return poolID(q.TC, q.Rated), true, nil
+}
+
+var leaveScript = redis.NewScript(`
+local n = redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('DEL', KEYS[4])
+return n
+`)
+
+// joinScript moves a seeker into a pool in one step, but only if its
+// waitingKey still holds what the caller read; it returns -1 otherwise. It
+// records the new pool, forgets any pairing left over from a previous
+// game, leaves the old pool and enqueues as EnqueueQuickplay does.
+var joinScript = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1]) or ''
+if cur ~= ARGV[2] then
+  return -1
+end
+if KEYS[4] ~= KEYS[6] then
+  redis.call('ZREM', KEYS[4], ARGV[1])
+  redis.call('HDEL', KEYS[5], ARGV[1])
+end
+redis.call('DEL', KEYS[2])
+redis.call('SET', KEYS[1], ARGV[3])
+redis.call('ZADD', KEYS[3], ARGV[7], ARGV[1])
+if redis.call('ZADD', KEYS[6], 'NX', ARGV[4], ARGV[1]) == 0 then
+  return 0
+end
+redis.call('HSET', KEYS[7], ARGV[1], ARGV[5])
+redis.call('SADD', KEYS[8], ARGV[6])
+return 1
+`)
+
+// joinAttempts bounds how often joinQueue retries after losing a race with
+// another request of the same user.
+const joinAttempts = 3
+
+var errQueueBusy = errors.New("queue entry changed concurrently")
+
+// joinQueue queues k for tc and rated, moving it out of any other pool
+// first: a user waits in one pool at a time. It reports whether k was newly
+// added to the pool.
+func joinQueue(ctx context.Context, s *store.Store, k Seeker, tc string, rated bool) (bool, error) {
+	pool := poolID(tc, rated)
+	want, _ := json.Marshal(waiting{TC: tc, Rated: rated})
+	info, _ := json.Marshal(k)
+	for range joinAttempts {
+		cur, err := s.Redis.Get(ctx, waitingKey(k.UserID)).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return false, err
+		}
+		old := pool
+		var q waiting
+		if cur != "" && json.Unmarshal([]byte(cur), &q) == nil {
+			old = poolID(q.TC, q.Rated)
+		}
+		n, err := joinScript.Run(ctx, s.Redis,
+			[]string{waitingKey(k.UserID), pairedKey(k.UserID), seenKey, poolKey(old), poolInfoKey(old), poolKey(pool), poolInfoKey(pool), poolsKey},
+			k.UserID, cur, want, k.Rating, info, pool, time.Now().UnixMilli()).Int()
+		if err != nil {
+			return false, err
+		}
+		if n >= 0 {
+			return n == 1, nil
+		}
+	}
+	return false, errQueueBusy
+}
+
+// leaveQueue takes userID out of whatever pool it waits in and reports
+// whether it was waiting.
+func leaveQueue(ctx context.Context, s *store.Store, userID string) (bool, error) {
+	pool, ok, err := currentPool(ctx, s, userID)
+	if err != nil || !ok {
+		return false, err
+	}
+	n, err := leaveScript.Run(ctx, s.Redis, []string{poolKey(pool), poolInfoKey(pool), seenKey, waitingKey(userID)}, userID).Int()
+	return n == 1, err
+}
+
+// touchSeeker records a heartbeat for userID if it is queued.
+func touchSeeker(ctx context.Context, s *store.Store, userID string) {
+	err := s.Redis.ZAddXX(ctx, seenKey, redis.Z{Score: float64(time.Now().UnixMilli()), Member: userID}).Err()
+	if err != nil {
+		log.Printf("queue heartbeat error: %v", err)
+	}
+}
+
+// SweepStale hands drop every seeker in seen (member user ID, score last
+// heartbeat in unix ms) silent for queueStaleAfter or longer at now,
+// stopping at the first error.
+func SweepStale(seen []redis.Z, now time.Time, drop func(userID string) error) error {
+	cutoff := now.Add(-queueStaleAfter).UnixMilli()
+	for _, z := range seen {
+		userID, _ := z.Member.(string)
+		if int64(z.Score) > cutoff {
+			continue
+		}
+		if err := drop(userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expireStale drops every seeker whose last heartbeat is too old.
+func expireStale(ctx context.Context, s *store.Store, now time.Time) error {
+	seen, err := s.Redis.ZRangeWithScores(ctx, seenKey, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	return SweepStale(seen, now, func(userID string) error {
+		if _, err := leaveQueue(ctx, s, userID); err != nil {
+			return err
+		}
+		// Not waiting anywhere any more (e.g. already paired).
+		return s.Redis.ZRem(ctx, seenKey, userID).Err()
+	})
+}
+
+// recordWaits remembers how long a new pair waited, for estimates.
+func recordWaits(ctx context.Context, s *store.Store, pool string, pair []Seeker) {
+	key := poolWaitsKey(pool)
+	pipe := s.Redis.TxPipeline()
+	for _, k := range pair {
+		pipe.LPush(ctx, key, time.Since(k.Since).Milliseconds())
+	}
+	pipe.LTrim(ctx, key, 0, recentWaits-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("queue wait stats error: %v", err)
+	}
+}
+
+// EstimateWait is how much longer someone who waited for waited can expect
+// to wait, from the average of recent waits in their pool.
+func EstimateWait(recent []time.Duration, waited time.Duration) (time.Duration, bool) {
+	if len(recent) == 0 {
+		return 0, false
+	}
+	var sum time.Duration
+	for _, d := range recent {
+		sum += d
+	}
+	return max(sum/time.Duration(len(recent))-waited, 0), true
+}
+
+// queueStatus describes userID's place in pool: its position by waiting
+// time, the pool size and, when known, the estimated remaining wait.
+func queueStatus(ctx context.Context, s *store.Store, pool, userID string) (map[string]any, error) {
+	seekers, err := loadPool(ctx, s, pool)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(seekers, func(i, j int) bool { return seekers[i].Since.Before(seekers[j].Since) })
+	status := map[string]any{"waiting": len(seekers)}
+	var since time.Time
+	for i, k := range seekers {
+		if k.UserID == userID {
+			status["position"], since = i+1, k.Since
+			break
+		}
+	}
+
+	vals, err := s.Redis.LRange(ctx, poolWaitsKey(pool), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	recent := make([]time.Duration, 0, len(vals))
+	for _, v := range vals {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			recent = append(recent, time.Duration(ms)*time.Millisecond)
+		}
+	}
+	if !since.IsZero() {
+		if eta, ok := EstimateWait(recent, time.Since(since)); ok {
+			status["estimatedWaitMs"] = eta.Milliseconds()
+		}
+	}
+	return status, nil
+}
+
+// CancelQuickplayHandler takes the caller out of the quickplay queue.
+func CancelQuickplayHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.UserIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s, err := store.New()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	left, err := leaveQueue(r.Context(), s, userID)
+	if err != nil {
+		log.Printf("queue cancel error: %v", err)
+		http.Error(w, "Queue error", http.StatusInternalServerError)
+		return
+	}
+	if !left {
+		http.Error(w, "Not queued", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,201 @@
+// Package matchkey owns the per-match HMAC keys both players sign moves with.
+// Keys are sealed with AES-GCM before they reach Postgres and are versioned by
+// generation so a resumed match can rotate without invalidating moves still
+// in flight under the previous key.
+package matchkey
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+
+	"p2p-chess/internal/store"
+)
+
+// DefaultGraceEvents is how many events may still be signed with the
+// previous key after a rotation when MATCH_KEY_GRACE_EVENTS is unset.
+const DefaultGraceEvents = 4
+
+var (
+	ErrNoKey        = errors.New("no key for match")
+	ErrBadSignature = errors.New("invalid signature")
+)
+
+var (
+	aead        cipher.AEAD
+	graceEvents = DefaultGraceEvents
+)
+
+func Init() error {
+	sec := os.Getenv("MATCH_KEY_SECRET")
+	if sec == "" {
+		return errors.New("MATCH_KEY_SECRET not set")
+	}
+	k := sha256.Sum256([]byte(sec))
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return err
+	}
+	aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	if v := os.Getenv("MATCH_KEY_GRACE_EVENTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errors.New("MATCH_KEY_GRACE_EVENTS must be a non-negative integer")
+		}
+		graceEvents = n
+	}
+	return nil
+}
+
+func GraceEvents() int {
+	return graceEvents
+}
+
+func Generate() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Seal encrypts key for storage as nonce||ciphertext.
+func Seal(key []byte) ([]byte, error) {
+	if aead == nil {
+		return nil, errors.New("matchkey not initialized")
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func Open(sealed []byte) ([]byte, error) {
+	if aead == nil {
+		return nil, errors.New("matchkey not initialized")
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed key too short")
+	}
+	nonce, ct := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ct, nil)
+}
+
+// Sign is the HMAC both players attach to an event, hex encoded.
+func Sign(key []byte, canonical string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Rotate issues the next key generation for matchID. grace is how many
+// further events may still be signed with the generation being replaced; use
+// zero when creating the first key.
+func Rotate(ctx context.Context, s *store.Store, matchID string, grace int) ([]byte, error) {
+	key, err := Generate()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := Seal(key)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var gen int
+	if err := tx.QueryRow(ctx, "SELECT key_generation FROM matches WHERE id = $1 FOR UPDATE", matchID).Scan(&gen); err != nil {
+		return nil, err
+	}
+	gen++
+	if _, err := tx.Exec(ctx, "INSERT INTO match_keys (match_id, generation, sealed) VALUES ($1, $2, $3)", matchID, gen, sealed); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, "UPDATE matches SET key_generation = $1, key_grace_left = $2 WHERE id = $3", gen, grace, matchID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Load returns generation gen of matchID's key in the clear.
+func Load(ctx context.Context, q store.DBTX, matchID string, gen int) ([]byte, error) {
+	var sealed []byte
+	err := q.QueryRow(ctx, "SELECT sealed FROM match_keys WHERE match_id = $1 AND generation = $2", matchID, gen).Scan(&sealed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Open(sealed)
+}
+
+// Verify checks sig over canonical against the current key, falling back to
+// the previous generation while its grace window lasts. Each event accepted
+// under the previous key uses up one grace slot. It returns the generation
+// that matched. Run it in the transaction that records the event so a
+// rejected event keeps its slot.
+func Verify(ctx context.Context, q store.DBTX, matchID, canonical, sig string) (int, error) {
+	var gen, graceLeft int
+	err := q.QueryRow(ctx, "SELECT key_generation, key_grace_left FROM matches WHERE id = $1", matchID).Scan(&gen, &graceLeft)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && gen == 0) {
+		return 0, ErrNoKey
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	candidates := []int{gen}
+	if graceLeft > 0 && gen > 1 {
+		candidates = append(candidates, gen-1)
+	}
+	for _, g := range candidates {
+		key, err := Load(ctx, q, matchID, g)
+		if err != nil {
+			return 0, err
+		}
+		if hmac.Equal([]byte(Sign(key, canonical)), []byte(sig)) {
+			if g != gen {
+				_, err := q.Exec(ctx, "UPDATE matches SET key_grace_left = GREATEST(key_grace_left - 1, 0) WHERE id = $1", matchID)
+				if err != nil {
+					return 0, err
+				}
+			}
+			return g, nil
+		}
+	}
+	return 0, ErrBadSignature
+}
+
+// Check verifies sig over canonical against generation gen only. Unlike
+// Verify it has no side effects, so it is safe for auditing recorded events.
+func Check(ctx context.Context, q store.DBTX, matchID string, gen int, canonical, sig string) error {
+	key, err := Load(ctx, q, matchID, gen)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(Sign(key, canonical)), []byte(sig)) {
+		return ErrBadSignature
+	}
+	return nil
+}
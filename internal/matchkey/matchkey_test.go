@@ -0,0 +1,37 @@
+package matchkey_test
+
+import (
+	"p2p-chess/internal/matchkey"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	t.Setenv("MATCH_KEY_SECRET", "test-secret")
+	assert.NoError(t, matchkey.Init())
+
+	key, err := matchkey.Generate()
+	assert.NoError(t, err)
+	sealed, err := matchkey.Seal(key)
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, sealed)
+
+	opened, err := matchkey.Open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, key, opened)
+
+	sealed[len(sealed)-1] ^= 0xff // Tampered ciphertext must not open
+	_, err = matchkey.Open(sealed)
+	assert.Error(t, err)
+}
+
+func TestGraceEventsFromEnv(t *testing.T) {
+	t.Setenv("MATCH_KEY_SECRET", "test-secret")
+	t.Setenv("MATCH_KEY_GRACE_EVENTS", "7")
+	assert.NoError(t, matchkey.Init())
+	assert.Equal(t, 7, matchkey.GraceEvents())
+
+	t.Setenv("MATCH_KEY_GRACE_EVENTS", "-1")
+	assert.Error(t, matchkey.Init())
+}
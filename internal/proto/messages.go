@@ -1,9 +1,94 @@
 package proto
 
+import "encoding/json"
+
+// Signaling frames are flat JSON objects tagged with an action.
+const (
+	ActionJoin   = "join"
+	ActionJoined = "joined"
+	ActionOffer  = "offer"
+	ActionAnswer = "answer"
+	ActionICE    = "ice"
+	ActionError  = "error"
+	ActionPeer   = "peer"
+	ActionPaired = "paired"
+
+	// Sent to a player when their opponent's resume rotated the match key.
+	ActionMatchKey = "match_key"
+
+	// Lobby: challenges addressed to a player and what became of theirs.
+	ActionChallenge = "challenge"
+
+	// Relayed mode: game traffic carried by the server when WebRTC fails.
+	ActionRelay        = "relay"
+	ActionRelayed      = "relayed"
+	ActionMove         = "move"
+	ActionResign       = "resign"
+	ActionDrawOffer    = "draw_offer"
+	ActionDrawResponse = "draw_response"
+	ActionAck          = "ack"
+	ActionCorrection   = "correction"
+	ActionResult       = "result"
+
+	// Clock sync: clients report RTT and displayed clocks, the server
+	// answers with a correction when they drifted.
+	ActionHeartbeat       = "heartbeat"
+	ActionClockCorrection = "clock_correction"
+)
+
+// Capabilities advertised in Join and Hello. A match is signed with Ed25519
+// when either player offers it; HMAC over the shared match key is the legacy
+// fallback, used only when both players offer it alone.
+const (
+	CapSigEd25519 = "sig-ed25519"
+	CapSigHMAC    = "sig-hmac"
+)
+
+// Signature algorithms recorded against each event.
+const (
+	SigAlgEd25519 = "ed25519"
+	SigAlgHMAC    = "hmac"
+)
+
+// SigAlg picks the signature algorithm for a player advertising caps.
+func SigAlg(caps []string) string {
+	for _, c := range caps {
+		if c == CapSigEd25519 {
+			return SigAlgEd25519
+		}
+	}
+	return SigAlgHMAC
+}
+
+type Envelope struct {
+	Action  string `json:"action"`
+	MatchID string `json:"matchId,omitempty"`
+}
+
+// Encode renders v as a frame tagged with action.
+func Encode(action string, v any) ([]byte, error) {
+	fields := map[string]any{}
+	if v != nil {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return nil, err
+		}
+	}
+	fields["action"] = action
+	return json.Marshal(fields)
+}
+
 // WS Client to Server
 type Join struct {
-	MatchID string `json:"matchId"`
-	Token   string `json:"token"`
+	MatchID string   `json:"matchId"`
+	Token   string   `json:"token"`
+	Caps    []string `json:"caps,omitempty"`
+	// PubKey is the player's per-match Ed25519 public key, base64 encoded.
+	// Required when Caps offers CapSigEd25519.
+	PubKey string `json:"pubKey,omitempty"`
 }
 
 type Offer struct {
@@ -29,20 +114,99 @@ type AppendMirror struct {
 type Heartbeat struct{}
 
 // WS Server to Client
-type Paired struct{}
+type Joined struct {
+	MatchID string `json:"matchId"`
+	Side    string `json:"side"`
+	SigAlg  string `json:"sigAlg"`
+}
+
+// PeerStatus tells a player whether their opponent's socket is connected.
+type PeerStatus struct {
+	Side      string `json:"side"`
+	Connected bool   `json:"connected"`
+}
+
+type Error struct {
+	Message string `json:"message"`
+}
+
+// Paired is delivered to each player once quickplay seats them in a match.
+type Paired struct {
+	MatchID      string            `json:"matchId"`
+	Side         string            `json:"side"`
+	Color        string            `json:"color"`
+	Sides        map[string]string `json:"sides"`
+	MatchKey     string            `json:"matchKey"`
+	JoinToken    string            `json:"joinToken"`
+	WebRTCConfig map[string]any    `json:"webrtcConfig"`
+}
+
+// MatchKey hands a player the match key their opponent's resume rotated in,
+// so both sign with the same generation once the grace window closes.
+type MatchKey struct {
+	MatchID  string `json:"matchId"`
+	MatchKey string `json:"matchKey"`
+}
+
+// Challenge tells a player about a challenge sent to them, or that one they
+// are party to was declined, cancelled or accepted.
+type Challenge struct {
+	ID        string `json:"id"`
+	From      string `json:"from"`
+	To        string `json:"to,omitempty"`
+	TC        string `json:"tc"`
+	Color     string `json:"color"`
+	Rated     bool   `json:"rated"`
+	FEN       string `json:"fen,omitempty"`
+	Status    string `json:"status"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+// Relayed announces that a match switched to server relay and where play
+// resumes.
+type Relayed struct {
+	MatchID    string `json:"matchId"`
+	LastSeq    int    `json:"lastSeq"`
+	FEN        string `json:"fen"`
+	SideToMove string `json:"sideToMove"`
+	MsWhite    int    `json:"msWhite"`
+	MsBlack    int    `json:"msBlack"`
+	ChainHead  string `json:"chainHead"`
+}
+
+// Ack confirms an event was recorded; Hash is the new chain head.
+type Ack struct {
+	Seq  int    `json:"seq"`
+	Hash string `json:"hash,omitempty"`
+}
 
+// Correction tells a client its view diverged from the referee: rewind to
+// RewindTo and continue from the FEN in Snapshot.
 type Correction struct {
-	RewindTo int    `json:"rewind_to"`
-	Snapshot string `json:"snapshot"`
+	RewindTo  int    `json:"rewind_to"`
+	Snapshot  string `json:"snapshot"`
+	ChainHead string `json:"chainHead,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	// MsWhite and MsBlack are the server's clocks when Reason is "clock".
+	MsWhite *int `json:"msWhite,omitempty"`
+	MsBlack *int `json:"msBlack,omitempty"`
 }
 
+// ClockCorrection gives the server's clocks as of ServerTime (unix ms) when
+// a client's displayed clocks drifted past tolerance. The clock of
+// SideToMove has kept running since.
 type ClockCorrection struct {
-	// Details
+	MatchID    string `json:"matchId"`
+	MsWhite    int    `json:"msWhite"`
+	MsBlack    int    `json:"msBlack"`
+	SideToMove string `json:"sideToMove"`
+	ServerTime int64  `json:"serverTime"`
 }
 
 type Result struct {
-	Result string `json:"result"`
-	Reason string `json:"reason"`
+	MatchID string `json:"matchId,omitempty"`
+	Result  string `json:"result"`
+	Reason  string `json:"reason"`
 }
 
 type AdminNotice struct {
@@ -55,6 +219,8 @@ type Hello struct {
 	MatchID string   `json:"matchId"`
 	Side    string   `json:"side"`
 	Caps    []string `json:"caps"`
+	// PubKey lets the peer check this player's Ed25519 signatures itself.
+	PubKey string `json:"pubKey,omitempty"`
 }
 
 type Move struct {
@@ -64,25 +230,38 @@ type Move struct {
 	MsWhite int    `json:"msWhite"`
 	MsBlack int    `json:"msBlack"`
 	Sig     string `json:"sig"`
+	// PrevHash is the chain head the sender built this event on.
+	PrevHash string `json:"prevHash"`
 }
 
 type Resign struct {
-	Seq int    `json:"seq"`
-	By  string `json:"by"`
+	Seq      int    `json:"seq"`
+	By       string `json:"by"`
+	Sig      string `json:"sig,omitempty"`
+	PrevHash string `json:"prevHash"`
 }
 
 type DrawOffer struct {
-	Seq int `json:"seq"`
+	Seq      int    `json:"seq"`
+	Sig      string `json:"sig,omitempty"`
+	PrevHash string `json:"prevHash"`
 }
 
 type DrawResponse struct {
-	Seq    int  `json:"seq"`
-	Accept bool `json:"accept"`
+	Seq      int    `json:"seq"`
+	Accept   bool   `json:"accept"`
+	Sig      string `json:"sig,omitempty"`
+	PrevHash string `json:"prevHash"`
 }
 
+// P2PHeartbeat is exchanged over the DataChannel and forwarded to the server
+// as a heartbeat frame. MsWhite and MsBlack are the clocks the sender
+// displays, when it wants them checked.
 type P2PHeartbeat struct {
-	Seq int `json:"seq"`
-	RTT int `json:"rtt"`
+	Seq     int  `json:"seq"`
+	RTT     int  `json:"rtt"`
+	MsWhite *int `json:"msWhite,omitempty"`
+	MsBlack *int `json:"msBlack,omitempty"`
 }
 
 // TODO: Versioning with "proto":1
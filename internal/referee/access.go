@@ -0,0 +1,84 @@
+package referee
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+
+	"p2p-chess/internal/auth"
+	"p2p-chess/internal/store"
+)
+
+var ErrNotParticipant = errors.New("not a participant")
+
+// SeatOf returns the side userID holds in matchID.
+func SeatOf(ctx context.Context, q store.DBTX, matchID, userID string) (string, error) {
+	var white, black string
+	err := q.QueryRow(ctx, "SELECT COALESCE(side_white::text, ''), COALESCE(side_black::text, '') FROM matches WHERE id = $1", matchID).Scan(&white, &black)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrMatchNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	switch userID {
+	case white:
+		return "w", nil
+	case black:
+		return "b", nil
+	}
+	return "", ErrNotParticipant
+}
+
+// AuthorizeSeat authenticates r and resolves the caller's side in matchID,
+// writing the 401/403/404 itself when that fails.
+func AuthorizeSeat(w http.ResponseWriter, r *http.Request, s *store.Store, matchID string) (string, bool) {
+	userID, err := auth.UserIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	side, err := SeatOf(r.Context(), s.DB, matchID, userID)
+	switch {
+	case errors.Is(err, ErrMatchNotFound):
+		http.Error(w, "Match not found", http.StatusNotFound)
+		return "", false
+	case errors.Is(err, ErrNotParticipant):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", false
+	case err != nil:
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return "", false
+	}
+	return side, true
+}
+
+// canSpectate admits anyone to public matches; private ones only admit
+// their players and admins.
+func canSpectate(r *http.Request, s *store.Store, matchID string) (int, bool) {
+	var private bool
+	err := s.DB.QueryRow(r.Context(), "SELECT private FROM matches WHERE id = $1", matchID).Scan(&private)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return http.StatusNotFound, false
+	}
+	if err != nil {
+		return http.StatusInternalServerError, false
+	}
+	if !private {
+		return http.StatusOK, true
+	}
+
+	tok, err := auth.TokenFromRequest(r)
+	if err != nil {
+		return http.StatusUnauthorized, false
+	}
+	if role, _ := tok.Get("role"); role == "admin" {
+		return http.StatusOK, true
+	}
+	if _, err := SeatOf(r.Context(), s.DB, matchID, tok.Subject()); err != nil {
+		return http.StatusForbidden, false
+	}
+	return http.StatusOK, true
+}
@@ -0,0 +1,213 @@
+package referee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	chess "github.com/corentings/chess/v2"
+	"github.com/go-chi/chi/v5"
+
+	"p2p-chess/internal/proto"
+	"p2p-chess/internal/store"
+)
+
+// MaxBatch caps how many moves one catch-up request may carry.
+const MaxBatch = 64
+
+var ErrBadBatch = errors.New("batch must hold between 1 and 64 moves")
+
+// Per-move outcomes of a batch.
+const (
+	BatchAccepted = "accepted"
+	BatchRejected = "rejected"
+	BatchSkipped  = "skipped"
+)
+
+type BatchMoveResult struct {
+	Seq    int    `json:"seq"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	Hash   string `json:"hash,omitempty"`
+}
+
+// BatchResult reports each move of a batch in order. Moves up to the first
+// rejection are recorded; Correction says where to resume when one diverged
+// and Result is set if the batch ended the game.
+type BatchResult struct {
+	Moves      []BatchMoveResult `json:"moves"`
+	Correction *proto.Correction `json:"correction,omitempty"`
+	Result     *proto.Result     `json:"result,omitempty"`
+}
+
+type BatchRequest struct {
+	Moves []AppendRequest `json:"moves"`
+}
+
+// AppendBatch records moves played peer-to-peer while side was cut off from
+// the server. Moves are checked in order against the authoritative position
+// and the accepted prefix is committed in one transaction; see RunBatch for
+// the per-move rules.
+func AppendBatch(ctx context.Context, s *store.Store, matchID, side string, moves []AppendRequest) (*BatchResult, error) {
+	if len(moves) == 0 || len(moves) > MaxBatch {
+		return nil, ErrBadBatch
+	}
+
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	m, err := lockMatch(ctx, tx, matchID)
+	if err != nil {
+		return nil, err
+	}
+	var floor time.Time
+	err = tx.QueryRow(ctx, `
+SELECT COALESCE(MAX(e.ts_server), MAX(m.started_at), MAX(m.created_at))
+FROM matches m LEFT JOIN match_events e ON e.match_id = m.id
+WHERE m.id = $1`, matchID).Scan(&floor)
+	if err != nil {
+		return nil, err
+	}
+	oppKey, err := playerKey(ctx, tx, matchID, opponent(side))
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := RunBatch(matchID, side, m.SideToMove, m.LastFEN, oppKey != nil, moves, floor, time.Now(),
+		func(req AppendRequest, tsClient, at time.Time) (*AppendResult, error) {
+			// Moves played while cut off get no lag compensation: their
+			// timing already comes from the client.
+			res, err := applyMove(ctx, tx, m, req, tsClient, at, 0)
+			var ce *CorrectionError
+			if errors.As(err, &ce) {
+				if err := recordCorrection(ctx, tx, m, req.Side, req.Seq, req.Sig, ce); err != nil {
+					return nil, err
+				}
+			}
+			return res, err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	switch {
+	case out.Result != nil:
+		afterFinish(ctx, s, matchID, out.Result.Result, out.Result.Reason)
+	case out.Moves[0].Status == BatchAccepted:
+		cacheClock(ctx, s, m)
+	}
+	if out.Correction != nil && out.Correction.Reason == "clock" {
+		pushClock(ctx, s, m)
+	}
+	return out, nil
+}
+
+// RunBatch walks a batch submitted by side, starting from fen with toMove to
+// play, and hands each move to apply until one is rejected or the game ends;
+// the rest are skipped. The opponent's moves must carry their own Ed25519
+// signature (opponentKeyed), since a shared match-key signature could have
+// been made by side.
+//
+// Each move's clock is charged at its ts_client, clamped between the
+// previous event's time (floor) and receipt (now) so a client cannot bank
+// time it did not spend waiting for the server.
+func RunBatch(matchID, side, toMove, fen string, opponentKeyed bool, moves []AppendRequest, floor, now time.Time,
+	apply func(req AppendRequest, tsClient, at time.Time) (*AppendResult, error)) (*BatchResult, error) {
+	out := &BatchResult{Moves: make([]BatchMoveResult, len(moves))}
+	stopped, over := false, false
+	for i, req := range moves {
+		r := &out.Moves[i]
+		r.Seq = req.Seq
+		if stopped {
+			r.Status = BatchSkipped
+			continue
+		}
+		stopped = true
+		r.Status = BatchRejected
+
+		if over {
+			r.Status, r.Reason = BatchSkipped, ErrMatchOver.Error()
+			continue
+		}
+		tsClient, err := time.Parse(time.RFC3339, req.TsClient)
+		if err != nil {
+			r.Reason = ErrBadTimestamp.Error()
+			continue
+		}
+		req.Side = toMove
+		if req.Side != side && !opponentKeyed {
+			r.Reason = "opponent move needs the opponent's own signature"
+			continue
+		}
+
+		at := tsClient
+		if at.Before(floor) {
+			at = floor
+		}
+		if at.After(now) {
+			at = now
+		}
+
+		res, err := apply(req, tsClient, at)
+		var ce *CorrectionError
+		switch {
+		case errors.As(err, &ce):
+			r.Reason = ce.Correction.Reason
+			out.Correction = &ce.Correction
+			continue
+		case errors.Is(err, ErrTimeout):
+			r.Reason = ErrTimeout.Error()
+			out.Result = &proto.Result{MatchID: matchID, Result: timeoutResult(fen, req.Side), Reason: "timeout"}
+			continue
+		case errors.Is(err, ErrBadSignature), errors.Is(err, ErrSigAlgMismatch):
+			r.Reason = err.Error()
+			continue
+		case err != nil:
+			return nil, err
+		}
+
+		stopped = false
+		r.Status, r.Hash = BatchAccepted, res.Hash
+		floor, fen = at, res.FEN
+		toMove = opponent(toMove)
+		if res.Outcome != chess.NoOutcome {
+			over = true
+			out.Result = &proto.Result{MatchID: matchID, Result: string(res.Outcome), Reason: res.Method.String()}
+		}
+	}
+	return out, nil
+}
+
+func AppendBatchHandler(w http.ResponseWriter, r *http.Request) {
+	matchID := chi.URLParam(r, "id")
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	s, err := store.New()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	side, ok := AuthorizeSeat(w, r, s, matchID)
+	if !ok {
+		return
+	}
+
+	res, err := AppendBatch(r.Context(), s, matchID, side, req.Moves)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,41 @@
+package referee
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"p2p-chess/internal/certificate"
+	"p2p-chess/internal/store"
+)
+
+// CertificateHandler serves the signed result certificate of a finished
+// match. Private matches only show it to their players and admins.
+func CertificateHandler(w http.ResponseWriter, r *http.Request) {
+	matchID := chi.URLParam(r, "id")
+	s, err := store.New()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if status, ok := canSpectate(r, s, matchID); !ok {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	token, err := certificate.Load(r.Context(), s.DB, matchID)
+	if errors.Is(err, certificate.ErrNotFinished) {
+		http.Error(w, "Match is not finished", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("certificate error: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"matchId": matchID, "certificate": token})
+}
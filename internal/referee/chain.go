@@ -0,0 +1,77 @@
+package referee
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+
+	"p2p-chess/internal/store"
+)
+
+// Every event commits to the one before it: hash = H(prev|type|canonical|sig).
+// Both peers can build the same chain from the frames they exchanged, so
+// comparing heads is enough to show their logs agree.
+
+// ChainGenesis is the prev hash of a match's first event.
+func ChainGenesis(matchID string) string {
+	sum := sha256.Sum256([]byte("p2p-chess/chain/" + matchID))
+	return hex.EncodeToString(sum[:])
+}
+
+// EventHash links an event of type typ, whose signature sig covers
+// canonical, onto prev.
+func EventHash(prev, typ, canonical, sig string) string {
+	h := sha256.New()
+	for _, part := range []string{prev, typ, canonical, sig} {
+		h.Write([]byte(part))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checkChain rejects an event whose claimed predecessor is not the current
+// head, including one that names none.
+func (m *matchState) checkChain(prevHash string) error {
+	if prevHash != m.ChainHead {
+		return m.diverged("chain")
+	}
+	return nil
+}
+
+// ChainHandler returns the head of a match's event chain so peers can check
+// their logs agree after a reconnect.
+func ChainHandler(w http.ResponseWriter, r *http.Request) {
+	matchID := chi.URLParam(r, "id")
+	s, err := store.New()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if status, ok := canSpectate(r, s, matchID); !ok {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	var seq int
+	var head *string
+	err = s.DB.QueryRow(r.Context(), "SELECT last_seq, chain_head FROM matches WHERE id = $1", matchID).Scan(&seq, &head)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Match not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if head == nil {
+		genesis := ChainGenesis(matchID)
+		head = &genesis
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"matchId": matchID, "seq": seq, "head": *head})
+}
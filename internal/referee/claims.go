@@ -0,0 +1,125 @@
+package referee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	chess "github.com/corentings/chess/v2"
+	"github.com/go-chi/chi/v5"
+
+	"p2p-chess/internal/engine"
+	"p2p-chess/internal/proto"
+	"p2p-chess/internal/store"
+)
+
+// StartFEN is the standard starting position. Matches created from a
+// challenge may start elsewhere, recorded in matches.start_fen.
+const StartFEN = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
+
+const (
+	ClaimThreefold = "threefold"
+	ClaimFiftyMove = "fifty"
+)
+
+var (
+	ErrUnknownClaim  = errors.New("unknown claim")
+	ErrClaimRejected = errors.New("claim not supported by the position")
+)
+
+// repetitions counts how often the position with key zobrist has occurred
+// in matchID, including the starting position and any move already logged
+// in the current transaction.
+func repetitions(ctx context.Context, q store.DBTX, matchID, zobrist string) (int, error) {
+	var n int
+	var start string
+	err := q.QueryRow(ctx, `
+SELECT (SELECT COUNT(*) FROM match_events WHERE match_id = $1 AND type = 'move' AND zobrist = $2), COALESCE(start_fen, $3)
+FROM matches WHERE id = $1`, matchID, zobrist, StartFEN).Scan(&n, &start)
+	if err != nil {
+		return 0, err
+	}
+	if ComputeZobrist(start) == zobrist {
+		n++
+	}
+	return n, nil
+}
+
+type ClaimRequest struct {
+	Kind string `json:"kind"`
+}
+
+// ClaimDraw lets either player end the game under the threefold repetition
+// or fifty-move rule once the current position qualifies.
+func ClaimDraw(ctx context.Context, s *store.Store, matchID, kind string) (*proto.Result, error) {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	m, err := lockMatch(ctx, tx, matchID)
+	if err != nil {
+		return nil, err
+	}
+
+	var method chess.Method
+	switch kind {
+	case ClaimThreefold:
+		n, err := repetitions(ctx, tx, matchID, ComputeZobrist(m.LastFEN))
+		if err != nil {
+			return nil, err
+		}
+		if n < 3 {
+			return nil, ErrClaimRejected
+		}
+		method = chess.ThreefoldRepetition
+	case ClaimFiftyMove:
+		clock, err := engine.HalfMoveClock(m.LastFEN)
+		if err != nil {
+			return nil, err
+		}
+		if clock < 100 {
+			return nil, ErrClaimRejected
+		}
+		method = chess.FiftyMoveRule
+	default:
+		return nil, ErrUnknownClaim
+	}
+
+	res := &proto.Result{MatchID: matchID, Result: string(chess.Draw), Reason: method.String()}
+	if err := finishMatch(ctx, tx, matchID, res.Result, res.Reason); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	afterFinish(ctx, s, matchID, res.Result, res.Reason)
+	return res, nil
+}
+
+func ClaimHandler(w http.ResponseWriter, r *http.Request) {
+	matchID := chi.URLParam(r, "id")
+	var req ClaimRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	s, err := store.New()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := AuthorizeSeat(w, r, s, matchID); !ok {
+		return
+	}
+
+	res, err := ClaimDraw(r.Context(), s, matchID, req.Kind)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"status": "accepted", "result": res.Result, "reason": res.Reason})
+}
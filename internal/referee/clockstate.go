@@ -0,0 +1,104 @@
+package referee
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"p2p-chess/internal/clock"
+	"p2p-chess/internal/store"
+)
+
+// Postgres holds the authoritative clocks, written in the same transaction
+// as each move. Redis keeps a copy so readers that only need the running
+// clocks (status polls, the flag watchdog) stay off the matches row.
+
+const clockTTL = 24 * time.Hour
+
+func clockKey(matchID string) string {
+	return "clock:{" + matchID + "}"
+}
+
+// cacheClock mirrors m's clocks to Redis after its transaction committed and
+// schedules its flag deadline for the watchdog.
+func cacheClock(ctx context.Context, s *store.Store, m *matchState) {
+	key := clockKey(m.ID)
+	tc, _ := json.Marshal(m.TC)
+	pipe := s.Redis.TxPipeline()
+	pipe.HSet(ctx, key,
+		"ms_white", m.MsWhite, "ms_black", m.MsBlack, "side", m.SideToMove,
+		"tick_white", unixMilli(m.TickWhite), "tick_black", unixMilli(m.TickBlack),
+		"tc", tc, "moves_white", m.MovesWhite, "moves_black", m.MovesBlack)
+	pipe.Expire(ctx, key, clockTTL)
+	if at, ok := m.flagDeadline(); ok {
+		pipe.ZAdd(ctx, deadlinesKey, redis.Z{Score: float64(at.UnixMilli()), Member: m.ID})
+	} else {
+		pipe.ZRem(ctx, deadlinesKey, m.ID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("clock cache error: %v", err)
+	}
+}
+
+func dropClock(ctx context.Context, s *store.Store, matchID string) {
+	pipe := s.Redis.TxPipeline()
+	pipe.Del(ctx, clockKey(matchID))
+	pipe.ZRem(ctx, deadlinesKey, matchID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("clock cache error: %v", err)
+	}
+}
+
+// LoadClock returns the clocks of a match in play, from Redis when cached
+// and otherwise from Postgres (refilling the cache).
+func LoadClock(ctx context.Context, s *store.Store, matchID string) (*clock.ClockState, error) {
+	vals, err := s.Redis.HGetAll(ctx, clockKey(matchID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) > 0 {
+		st := &clock.ClockState{SideToMove: vals["side"]}
+		st.MsWhite, _ = strconv.Atoi(vals["ms_white"])
+		st.MsBlack, _ = strconv.Atoi(vals["ms_black"])
+		st.MovesWhite, _ = strconv.Atoi(vals["moves_white"])
+		st.MovesBlack, _ = strconv.Atoi(vals["moves_black"])
+		_ = json.Unmarshal([]byte(vals["tc"]), &st.TC)
+		st.LastTickWhite = fromUnixMilli(vals["tick_white"])
+		st.LastTickBlack = fromUnixMilli(vals["tick_black"])
+		return st, nil
+	}
+
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	m, err := lockMatch(ctx, tx, matchID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	cacheClock(ctx, s, m)
+	return m.clock(), nil
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func fromUnixMilli(v string) time.Time {
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
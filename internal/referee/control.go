@@ -0,0 +1,259 @@
+package referee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+
+	"p2p-chess/internal/proto"
+	"p2p-chess/internal/store"
+)
+
+var (
+	ErrNoDrawOffer = errors.New("no draw offer pending")
+	ErrDrawPending = errors.New("draw offer already pending")
+)
+
+// ControlRequest is the body of the resign and draw endpoints. Sig covers
+// ControlCanonical, made with the player's Ed25519 key or the match key.
+type ControlRequest struct {
+	Seq      int    `json:"seq"`
+	Accept   bool   `json:"accept"`
+	TsClient string `json:"tsClient"`
+	Sig      string `json:"sig"`
+	PrevHash string `json:"prevHash"`
+}
+
+// ControlCanonical is what a resign or draw signature covers; typ is the
+// match_events type, or "draw_decline" for a refused offer.
+func ControlCanonical(typ string, seq int, side string) string {
+	return fmt.Sprintf("%s|%d|%s", typ, seq, side)
+}
+
+// Resign records side giving up and finishes the match.
+func Resign(ctx context.Context, s *store.Store, matchID, side string, req ControlRequest) (*proto.Result, error) {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	m, err := lockMatch(ctx, tx, matchID)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordControl(ctx, tx, m, "resign", side, req); err != nil {
+		return nil, commitCorrection(ctx, tx, m, side, req.Seq, req.Sig, err)
+	}
+	res := &proto.Result{MatchID: matchID, Result: winFor(opponent(side)), Reason: "resignation"}
+	if err := finishMatch(ctx, tx, matchID, res.Result, res.Reason); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	afterFinish(ctx, s, matchID, res.Result, res.Reason)
+	return res, nil
+}
+
+// OfferDraw records a draw offer by side. It stays open until the opponent
+// answers or the next move is played.
+func OfferDraw(ctx context.Context, s *store.Store, matchID, side string, req ControlRequest) error {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	m, err := lockMatch(ctx, tx, matchID)
+	if err != nil {
+		return err
+	}
+	if m.DrawOfferBy != "" {
+		return ErrDrawPending
+	}
+	if err := recordControl(ctx, tx, m, "draw_offer", side, req); err != nil {
+		return commitCorrection(ctx, tx, m, side, req.Seq, req.Sig, err)
+	}
+	if _, err := tx.Exec(ctx, "UPDATE matches SET draw_offer_by = $1, draw_offer_seq = $2 WHERE id = $3", side, req.Seq, matchID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// RespondDraw answers the opponent's pending offer. Accepting finishes the
+// match as a draw; declining just withdraws the offer and records nothing.
+func RespondDraw(ctx context.Context, s *store.Store, matchID, side string, req ControlRequest) (*proto.Result, error) {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	m, err := lockMatch(ctx, tx, matchID)
+	if err != nil {
+		return nil, err
+	}
+	if m.DrawOfferBy == "" {
+		return nil, ErrNoDrawOffer
+	}
+	if m.DrawOfferBy == side {
+		return nil, ErrWrongSide
+	}
+
+	if !req.Accept {
+		if _, err := verifySig(ctx, tx, matchID, side, ControlCanonical("draw_decline", req.Seq, side), req.Sig); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(ctx, "UPDATE matches SET draw_offer_by = NULL, draw_offer_seq = NULL WHERE id = $1", matchID); err != nil {
+			return nil, err
+		}
+		return nil, tx.Commit(ctx)
+	}
+
+	if err := recordControl(ctx, tx, m, "draw_accept", side, req); err != nil {
+		return nil, commitCorrection(ctx, tx, m, side, req.Seq, req.Sig, err)
+	}
+	res := &proto.Result{MatchID: matchID, Result: "1/2-1/2", Reason: "agreement"}
+	if err := finishMatch(ctx, tx, matchID, res.Result, res.Reason); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	afterFinish(ctx, s, matchID, res.Result, res.Reason)
+	return res, nil
+}
+
+// recordControl checks seq and signature of a non-move event and appends it
+// to the log at the current position.
+func recordControl(ctx context.Context, tx pgx.Tx, m *matchState, typ, side string, req ControlRequest) error {
+	if req.Seq != m.LastSeq+1 {
+		return m.diverged("seq")
+	}
+	if err := m.checkChain(req.PrevHash); err != nil {
+		return err
+	}
+	canonical := ControlCanonical(typ, req.Seq, side)
+	sig, err := verifySig(ctx, tx, m.ID, side, canonical, req.Sig)
+	if err != nil {
+		return err
+	}
+	var tsClient *time.Time
+	if req.TsClient != "" {
+		t, err := time.Parse(time.RFC3339, req.TsClient)
+		if err != nil {
+			return ErrBadTimestamp
+		}
+		tsClient = &t
+	}
+	payload, _ := json.Marshal(map[string]interface{}{"fen": m.LastFEN})
+	hash := EventHash(m.ChainHead, typ, canonical, req.Sig)
+	_, err = tx.Exec(ctx, "INSERT INTO match_events (match_id, seq, type, payload, side, ts_client, ts_server, zobrist, sig, valid, key_generation, sig_alg, prev_hash, hash) VALUES ($1, $2, $3, $4, $5, $6, NOW(), $7, $8, true, $9, $10, $11, $12)",
+		m.ID, req.Seq, typ, payload, side, tsClient, ComputeZobrist(m.LastFEN), req.Sig, sig.KeyGen, sig.Alg, m.ChainHead, hash)
+	if err != nil {
+		return fmt.Errorf("insert event: %w", err)
+	}
+	_, err = tx.Exec(ctx, "UPDATE matches SET last_seq = $1, chain_head = $2 WHERE id = $3", req.Seq, hash, m.ID)
+	return err
+}
+
+func ResignHandler(w http.ResponseWriter, r *http.Request) {
+	serveControl(w, r, func(ctx context.Context, s *store.Store, matchID, side string, req ControlRequest) (*proto.Result, error) {
+		return Resign(ctx, s, matchID, side, req)
+	})
+}
+
+func DrawOfferHandler(w http.ResponseWriter, r *http.Request) {
+	serveControl(w, r, func(ctx context.Context, s *store.Store, matchID, side string, req ControlRequest) (*proto.Result, error) {
+		return nil, OfferDraw(ctx, s, matchID, side, req)
+	})
+}
+
+func DrawResponseHandler(w http.ResponseWriter, r *http.Request) {
+	serveControl(w, r, RespondDraw)
+}
+
+func serveControl(w http.ResponseWriter, r *http.Request, fn func(context.Context, *store.Store, string, string, ControlRequest) (*proto.Result, error)) {
+	matchID := chi.URLParam(r, "id")
+	var req ControlRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	s, err := store.New()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	side, ok := AuthorizeSeat(w, r, s, matchID)
+	if !ok {
+		return
+	}
+
+	res, err := fn(r.Context(), s, matchID, side, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]any{"status": "accepted"}
+	if res != nil {
+		resp["result"] = res.Result
+		resp["reason"] = res.Reason
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeError maps referee errors onto HTTP responses; divergence answers 409
+// with the correction the client should apply.
+func writeError(w http.ResponseWriter, err error) {
+	var ce *CorrectionError
+	switch {
+	case errors.As(err, &ce):
+		frame, _ := proto.Encode(proto.ActionCorrection, ce.Correction)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write(frame)
+	case errors.Is(err, ErrMatchOver):
+		http.Error(w, "Match is not in progress", http.StatusConflict)
+	case errors.Is(err, ErrBadSignature):
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+	case errors.Is(err, ErrSigAlgMismatch):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, ErrMatchNotFound):
+		http.Error(w, "Match not found", http.StatusNotFound)
+	case errors.Is(err, ErrIllegalMove):
+		http.Error(w, "Invalid move", http.StatusBadRequest)
+	case errors.Is(err, ErrBadTimestamp):
+		http.Error(w, "Invalid timestamp", http.StatusBadRequest)
+	case errors.Is(err, ErrTimeout):
+		http.Error(w, "Timeout", http.StatusBadRequest)
+	case errors.Is(err, ErrDrawPending), errors.Is(err, ErrNoDrawOffer):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrBadBatch):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrLogSubmitted):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrDisputeNotFound):
+		http.Error(w, "Dispute not found", http.StatusNotFound)
+	case errors.Is(err, ErrBadResult), errors.Is(err, ErrEmptyLog):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrClaimRejected):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrUnknownClaim):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrWrongSide):
+		http.Error(w, "Only the opponent can answer a draw offer", http.StatusForbidden)
+	default:
+		log.Printf("referee error: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+	}
+}
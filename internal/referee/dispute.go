@@ -0,0 +1,599 @@
+package referee
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	chess "github.com/corentings/chess/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+
+	"p2p-chess/internal/certificate"
+	"p2p-chess/internal/matchkey"
+	"p2p-chess/internal/proto"
+	"p2p-chess/internal/signaling"
+	"p2p-chess/internal/store"
+)
+
+// Dispute decisions.
+const (
+	DecisionRewind   = "rewind"   // server line stands; players rewind to it
+	DecisionForfeit  = "forfeit"  // a player signed two different events for one seq
+	DecisionRejected = "rejected" // the uploaded log does not verify
+	DecisionOverride = "override" // set by an admin
+)
+
+var (
+	ErrDisputeNotFound = errors.New("dispute not found")
+	ErrLogSubmitted    = errors.New("log already submitted for this dispute")
+	ErrBadResult       = errors.New("invalid result")
+	ErrEmptyLog        = errors.New("log is empty")
+)
+
+// LogEntry is one signed event from a player's local log, as exchanged over
+// the data channel.
+type LogEntry struct {
+	Seq     int    `json:"seq"`
+	Type    string `json:"type"`
+	Side    string `json:"side"`
+	UCI     string `json:"uci,omitempty"`
+	FEN     string `json:"fen,omitempty"`
+	MsWhite int    `json:"msWhite,omitempty"`
+	MsBlack int    `json:"msBlack,omitempty"`
+	Sig     string `json:"sig"`
+}
+
+// Canonical is the string the entry's signature covers.
+func (e LogEntry) Canonical() string {
+	if e.Type == "move" {
+		return MoveCanonical(e.Seq, e.UCI, e.FEN, e.MsWhite, e.MsBlack)
+	}
+	return ControlCanonical(e.Type, e.Seq, e.Side)
+}
+
+// SigCheck grades a log entry's signature. Only SigOwn, a valid signature
+// with the signer's own Ed25519 key, can be held against that player;
+// anyone holding the match key could have made a SigShared one.
+type SigCheck int
+
+const (
+	SigInvalid SigCheck = iota
+	SigShared
+	SigOwn
+)
+
+// Verdict is the referee's ruling on a dispute.
+type Verdict struct {
+	Decision string `json:"decision"`
+	Reason   string `json:"reason"`
+	// Forfeits is the side that equivocated, for DecisionForfeit.
+	Forfeits string `json:"forfeits,omitempty"`
+	// Extend holds the moves past the server's line that both logs agree
+	// on, for DecisionRewind. They still have to pass the referee before
+	// they join the line.
+	Extend []LogEntry `json:"extend,omitempty"`
+}
+
+// Adjudicate compares the server's log with the players' uploaded logs
+// (keyed by side). A log that does not verify is rejected; a player who
+// signed two different events for the same seq with their own key forfeits;
+// otherwise the server's line stands, extended by any moves past it that
+// both logs hold identically, and play rewinds to it. Signatures in
+// corrected belong to events the server rejected with a correction; the
+// player re-signed that seq on its instruction, so those never count as
+// equivocation.
+func Adjudicate(server []LogEntry, logs map[string][]LogEntry, corrected map[string]bool, check func(LogEntry) SigCheck) Verdict {
+	for _, side := range []string{"w", "b"} {
+		entries, ok := logs[side]
+		if !ok {
+			continue
+		}
+		for i, e := range entries {
+			if e.Seq != i+1 {
+				return Verdict{Decision: DecisionRejected, Reason: fmt.Sprintf("%s log: seq %d out of order", side, e.Seq)}
+			}
+			if check(e) == SigInvalid {
+				return Verdict{Decision: DecisionRejected, Reason: fmt.Sprintf("%s log: seq %d signature invalid", side, e.Seq)}
+			}
+		}
+	}
+
+	// Every signed version of each seq, server first.
+	bySeq := map[int][]LogEntry{}
+	for _, e := range server {
+		bySeq[e.Seq] = append(bySeq[e.Seq], e)
+	}
+	for _, side := range []string{"w", "b"} {
+		for _, e := range logs[side] {
+			bySeq[e.Seq] = append(bySeq[e.Seq], e)
+		}
+	}
+	for seq := 1; seq <= len(bySeq); seq++ {
+		versions := bySeq[seq]
+		for i := 0; i < len(versions); i++ {
+			for j := i + 1; j < len(versions); j++ {
+				a, b := versions[i], versions[j]
+				if a.Side != b.Side || (a.Type == b.Type && a.Canonical() == b.Canonical()) {
+					continue
+				}
+				if corrected[a.Sig] || corrected[b.Sig] {
+					continue
+				}
+				if check(a) == SigOwn && check(b) == SigOwn {
+					return Verdict{Decision: DecisionForfeit, Forfeits: a.Side,
+						Reason: fmt.Sprintf("%s signed two different events for seq %d", a.Side, seq)}
+				}
+			}
+		}
+	}
+
+	// Moves both players hold past the server's line were played peer to
+	// peer and never mirrored; they are the only part of a log that can
+	// extend it.
+	var extend []LogEntry
+	if w, b := logs["w"], logs["b"]; len(logs) == 2 {
+		for i := len(server); i < len(w) && i < len(b); i++ {
+			if w[i].Type != "move" || !sameEvent(w[i], b[i]) {
+				break
+			}
+			extend = append(extend, logs[w[i].Side][i])
+		}
+	}
+	line := append(server[:len(server):len(server)], extend...)
+
+	reason := "logs agree with the server"
+	if len(extend) > 0 {
+		reason = fmt.Sprintf("logs agree on %d moves past the server", len(extend))
+	}
+	for _, side := range []string{"w", "b"} {
+		if at := divergence(line, logs[side]); at > 0 {
+			reason = fmt.Sprintf("%s log diverges from the server at seq %d; server line kept", side, at)
+			break
+		}
+	}
+	return Verdict{Decision: DecisionRewind, Reason: reason, Extend: extend}
+}
+
+// sameEvent reports whether a and b record the same signed event.
+func sameEvent(a, b LogEntry) bool {
+	return a.Type == b.Type && a.Side == b.Side && a.Canonical() == b.Canonical()
+}
+
+// divergence is the first seq where entries departs from server, or 0.
+func divergence(server, entries []LogEntry) int {
+	for i, e := range entries {
+		if i >= len(server) {
+			return e.Seq
+		}
+		if !sameEvent(server[i], e) {
+			return e.Seq
+		}
+	}
+	return 0
+}
+
+// serverLog reads matchID's recorded events back into log entries.
+func serverLog(ctx context.Context, q store.DBTX, matchID string) ([]LogEntry, error) {
+	rows, err := q.Query(ctx, "SELECT seq, type, payload, COALESCE(side, ''), sig FROM match_events WHERE match_id = $1 ORDER BY seq", matchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []LogEntry
+	for rows.Next() {
+		var e LogEntry
+		var payload, sig []byte
+		if err := rows.Scan(&e.Seq, &e.Type, &payload, &e.Side, &sig); err != nil {
+			return nil, err
+		}
+		e.Sig = string(sig)
+		if e.Type == "move" {
+			var p movePayload
+			if err := json.Unmarshal(payload, &p); err != nil {
+				return nil, err
+			}
+			signed := signedMove{FEN: p.FENBefore, MsWhite: p.MsWhite, MsBlack: p.MsBlack}
+			if p.Signed != nil {
+				signed = *p.Signed
+			}
+			e.UCI, e.FEN, e.MsWhite, e.MsBlack = p.UCI, signed.FEN, signed.MsWhite, signed.MsBlack
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// correctedSigs returns the signatures of matchID's events that the server
+// answered with a correction.
+func correctedSigs(ctx context.Context, q store.DBTX, matchID string) (map[string]bool, error) {
+	rows, err := q.Query(ctx, "SELECT sig FROM match_corrections WHERE match_id = $1", matchID)
+	if err != nil {
+		return nil, err
+	}
+	sigs, err := pgx.CollectRows(rows, pgx.RowTo[[]byte])
+	if err != nil {
+		return nil, err
+	}
+	corrected := make(map[string]bool, len(sigs))
+	for _, sig := range sigs {
+		corrected[string(sig)] = true
+	}
+	return corrected, nil
+}
+
+// sigChecker grades entries of matchID: against the signer's own key when
+// they registered one, otherwise against every match key generation.
+func sigChecker(ctx context.Context, q store.DBTX, matchID string) (func(LogEntry) SigCheck, error) {
+	keys := map[string]ed25519.PublicKey{}
+	for _, side := range []string{"w", "b"} {
+		pub, err := playerKey(ctx, q, matchID, side)
+		if err != nil {
+			return nil, err
+		}
+		if pub != nil {
+			keys[side] = pub
+		}
+	}
+	rows, err := q.Query(ctx, "SELECT generation FROM match_keys WHERE match_id = $1 ORDER BY generation", matchID)
+	if err != nil {
+		return nil, err
+	}
+	gens, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, err
+	}
+
+	return func(e LogEntry) SigCheck {
+		if pub, ok := keys[e.Side]; ok {
+			if CheckPlayerSig(pub, e.Canonical(), e.Sig) == nil {
+				return SigOwn
+			}
+			return SigInvalid
+		}
+		for _, g := range gens {
+			if matchkey.Check(ctx, q, matchID, g, e.Canonical(), e.Sig) == nil {
+				return SigShared
+			}
+		}
+		return SigInvalid
+	}, nil
+}
+
+// Dispute is a stored dispute and its ruling.
+type Dispute struct {
+	ID         string     `json:"id"`
+	MatchID    string     `json:"matchId"`
+	OpenedBy   string     `json:"openedBy"`
+	Status     string     `json:"status"`
+	Decision   string     `json:"decision,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	Result     string     `json:"result,omitempty"`
+	RewindTo   *int       `json:"rewindTo,omitempty"`
+	LogWhite   []LogEntry `json:"logWhite,omitempty"`
+	LogBlack   []LogEntry `json:"logBlack,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+}
+
+// SubmitLog files side's log against matchID, opening a dispute or joining
+// the open one, and rules on every log submitted so far. A forfeit, or a
+// ruling with both logs in, closes the dispute; until then it stays open for
+// the opponent's log. Moves the ruling extends the line with are run past
+// the referee in order, and play rewinds to the last one that holds up.
+func SubmitLog(ctx context.Context, s *store.Store, matchID, side string, entries []LogEntry) (*Dispute, error) {
+	if len(entries) == 0 {
+		return nil, ErrEmptyLog
+	}
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var status, lastFEN, chainHead string
+	var lastSeq int
+	err = tx.QueryRow(ctx, "SELECT status, last_seq, last_fen, COALESCE(chain_head, '') FROM matches WHERE id = $1 FOR UPDATE", matchID).
+		Scan(&status, &lastSeq, &lastFEN, &chainHead)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMatchNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Dispute{MatchID: matchID}
+	var logW, logB []byte
+	err = tx.QueryRow(ctx, "SELECT id, opened_by, log_white, log_black, created_at FROM disputes WHERE match_id = $1 AND status = 'open' ORDER BY created_at DESC LIMIT 1", matchID).
+		Scan(&d.ID, &d.OpenedBy, &logW, &logB, &d.CreatedAt)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		d.OpenedBy = side
+		err = tx.QueryRow(ctx, "INSERT INTO disputes (match_id, opened_by) VALUES ($1, $2) RETURNING id, created_at", matchID, side).
+			Scan(&d.ID, &d.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+	if logW != nil {
+		json.Unmarshal(logW, &d.LogWhite)
+	}
+	if logB != nil {
+		json.Unmarshal(logB, &d.LogBlack)
+	}
+	if (side == "w" && logW != nil) || (side == "b" && logB != nil) {
+		return nil, ErrLogSubmitted
+	}
+	if side == "w" {
+		d.LogWhite = entries
+	} else {
+		d.LogBlack = entries
+	}
+
+	server, err := serverLog(ctx, tx, matchID)
+	if err != nil {
+		return nil, err
+	}
+	check, err := sigChecker(ctx, tx, matchID)
+	if err != nil {
+		return nil, err
+	}
+	corrected, err := correctedSigs(ctx, tx, matchID)
+	if err != nil {
+		return nil, err
+	}
+	logs := map[string][]LogEntry{}
+	if d.LogWhite != nil {
+		logs["w"] = d.LogWhite
+	}
+	if d.LogBlack != nil {
+		logs["b"] = d.LogBlack
+	}
+	v := Adjudicate(server, logs, corrected, check)
+	d.Decision, d.Reason = v.Decision, v.Reason
+
+	d.Status = "open"
+	if v.Decision == DecisionForfeit || len(logs) == 2 {
+		d.Status = "resolved"
+	}
+	var finish bool
+	var finishResult, finishReason string
+	if v.Decision == DecisionRewind && len(v.Extend) > 0 && (status == "live" || status == "relayed") {
+		m, err := lockMatch(ctx, tx, matchID)
+		if err != nil {
+			return nil, err
+		}
+		if finishResult, finishReason, err = extendLine(ctx, tx, m, v.Extend); err != nil {
+			return nil, err
+		}
+		lastSeq, lastFEN, chainHead, status = m.LastSeq, m.LastFEN, m.ChainHead, m.Status
+	}
+	if v.Decision == DecisionRewind {
+		d.RewindTo = &lastSeq
+	}
+	if v.Decision == DecisionForfeit {
+		d.Result = winFor(opponent(v.Forfeits))
+		if finish, err = setResult(ctx, tx, matchID, status, d.Result, "equivocation"); err != nil {
+			return nil, err
+		}
+	}
+
+	entriesJSON, _ := json.Marshal(entries)
+	col := "log_white"
+	if side == "b" {
+		col = "log_black"
+	}
+	_, err = tx.Exec(ctx, "UPDATE disputes SET "+col+" = $1, status = $2, decision = $3, reason = $4, result = $5, rewind_to = $6, resolved_at = CASE WHEN $2 = 'open' THEN NULL ELSE NOW() END WHERE id = $7",
+		entriesJSON, d.Status, d.Decision, d.Reason, nullIfEmpty(d.Result), d.RewindTo, d.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case finishResult != "":
+		afterFinish(ctx, s, matchID, finishResult, finishReason)
+	case finish:
+		afterFinish(ctx, s, matchID, d.Result, "equivocation")
+	case v.Decision == DecisionForfeit:
+		afterResultChange(ctx, s, matchID, d.Result, "equivocation")
+	case v.Decision == DecisionRewind && (status == "live" || status == "relayed"):
+		frame, _ := proto.Encode(proto.ActionCorrection, proto.Correction{RewindTo: lastSeq, Snapshot: lastFEN, ChainHead: chainHead, Reason: "dispute"})
+		if err := signaling.Publish(ctx, s, matchID, "", frame); err != nil {
+			log.Printf("dispute correction error: %v", err)
+		}
+	}
+	return d, nil
+}
+
+// extendLine runs the agreed moves past m's line through the referee in tx,
+// stopping at the first one that does not hold up. If one of them ends the
+// game it returns the result and reason the caller owes afterFinish.
+func extendLine(ctx context.Context, tx pgx.Tx, m *matchState, moves []LogEntry) (string, string, error) {
+	now := time.Now()
+	for _, e := range moves {
+		req := AppendRequest{Seq: e.Seq, UCI: e.UCI, FEN: e.FEN, MsWhite: e.MsWhite, MsBlack: e.MsBlack,
+			Side: e.Side, Sig: e.Sig, PrevHash: m.ChainHead}
+		res, err := applyMove(ctx, tx, m, req, now, now, 0)
+		var ce *CorrectionError
+		switch {
+		case errors.Is(err, ErrTimeout):
+			return winFor(opponent(e.Side)), "timeout", nil
+		case errors.As(err, &ce), errors.Is(err, ErrBadSignature), errors.Is(err, ErrSigAlgMismatch):
+			return "", "", nil
+		case err != nil:
+			return "", "", err
+		}
+		if res.Outcome != chess.NoOutcome {
+			return string(res.Outcome), res.Method.String(), nil
+		}
+	}
+	return "", "", nil
+}
+
+// setResult records result for matchID inside tx. It reports whether the
+// match was still being played, in which case the caller owes afterFinish.
+func setResult(ctx context.Context, tx pgx.Tx, matchID, status, result, reason string) (bool, error) {
+	if status == "live" || status == "relayed" {
+		return true, finishMatch(ctx, tx, matchID, result, reason)
+	}
+	_, err := tx.Exec(ctx, "UPDATE matches SET status = 'finished', result = $1, reason = $2, finished_at = COALESCE(finished_at, NOW()) WHERE id = $3",
+		result, reason, matchID)
+	return false, err
+}
+
+// afterResultChange reissues the certificate of a match whose result was
+// changed after it finished and tells the players. Ratings already applied
+// are left alone.
+func afterResultChange(ctx context.Context, s *store.Store, matchID, result, reason string) {
+	if _, err := certificate.Issue(ctx, s.DB, matchID); err != nil {
+		log.Printf("certificate error: %v", err)
+	}
+	frame, _ := proto.Encode(proto.ActionResult, proto.Result{MatchID: matchID, Result: result, Reason: reason})
+	if err := signaling.Publish(ctx, s, matchID, "", frame); err != nil {
+		log.Printf("result notification error: %v", err)
+	}
+}
+
+// OverrideDispute lets an admin replace the ruling on disputeID with result
+// and reason, which are applied to the match.
+func OverrideDispute(ctx context.Context, s *store.Store, disputeID, adminID, result, reason string) (*Dispute, error) {
+	switch result {
+	case "1-0", "0-1", "1/2-1/2":
+	default:
+		return nil, ErrBadResult
+	}
+
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var matchID, status string
+	err = tx.QueryRow(ctx, "SELECT d.match_id::text, m.status FROM disputes d JOIN matches m ON m.id = d.match_id WHERE d.id = $1 FOR UPDATE OF d, m", disputeID).
+		Scan(&matchID, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrDisputeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	finish, err := setResult(ctx, tx, matchID, status, result, "adjudication")
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, "UPDATE disputes SET status = 'overridden', decision = $1, reason = $2, result = $3, resolved_at = NOW(), resolved_by = $4 WHERE id = $5",
+		DecisionOverride, reason, result, adminID, disputeID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	if finish {
+		afterFinish(ctx, s, matchID, result, "adjudication")
+	} else {
+		afterResultChange(ctx, s, matchID, result, "adjudication")
+	}
+	return LoadDispute(ctx, s.DB, disputeID)
+}
+
+const disputeColumns = "id::text, match_id::text, opened_by, status, COALESCE(decision, ''), COALESCE(reason, ''), COALESCE(result, ''), rewind_to, log_white, log_black, created_at, resolved_at"
+
+func scanDispute(row pgx.Row) (*Dispute, error) {
+	d := &Dispute{}
+	var logW, logB []byte
+	err := row.Scan(&d.ID, &d.MatchID, &d.OpenedBy, &d.Status, &d.Decision, &d.Reason, &d.Result, &d.RewindTo, &logW, &logB, &d.CreatedAt, &d.ResolvedAt)
+	if err != nil {
+		return nil, err
+	}
+	if logW != nil {
+		json.Unmarshal(logW, &d.LogWhite)
+	}
+	if logB != nil {
+		json.Unmarshal(logB, &d.LogBlack)
+	}
+	return d, nil
+}
+
+// LoadDispute returns disputeID with both logs.
+func LoadDispute(ctx context.Context, q store.DBTX, disputeID string) (*Dispute, error) {
+	d, err := scanDispute(q.QueryRow(ctx, "SELECT "+disputeColumns+" FROM disputes WHERE id = $1", disputeID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrDisputeNotFound
+	}
+	return d, err
+}
+
+// ListDisputes returns disputes with status, newest first; an empty status
+// lists them all.
+func ListDisputes(ctx context.Context, q store.DBTX, status string, limit int) ([]*Dispute, error) {
+	rows, err := q.Query(ctx, "SELECT "+disputeColumns+" FROM disputes WHERE $1 = '' OR status = $1 ORDER BY created_at DESC LIMIT $2", status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	disputes := []*Dispute{}
+	for rows.Next() {
+		d, err := scanDispute(rows)
+		if err != nil {
+			return nil, err
+		}
+		disputes = append(disputes, d)
+	}
+	return disputes, rows.Err()
+}
+
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+type DisputeRequest struct {
+	Log []LogEntry `json:"log"`
+}
+
+// DisputeHandler lets a seated player upload their local log for a ruling.
+func DisputeHandler(w http.ResponseWriter, r *http.Request) {
+	matchID := chi.URLParam(r, "id")
+	var req DisputeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	s, err := store.New()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	side, ok := AuthorizeSeat(w, r, s, matchID)
+	if !ok {
+		return
+	}
+
+	d, err := SubmitLog(r.Context(), s, matchID, side, req.Log)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// The opponent's log stays private until an admin looks at it.
+	if side == "w" {
+		d.LogBlack = nil
+	} else {
+		d.LogWhite = nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,82 @@
+package referee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"p2p-chess/internal/clock"
+	"p2p-chess/internal/proto"
+	"p2p-chess/internal/signaling"
+	"p2p-chess/internal/store"
+)
+
+// A player's round trip is measured by signaling pings and by the
+// P2PHeartbeat RTT their client reports, and smoothed in Redis. Samples
+// above maxRTTMs are clamped; lag compensation is bounded separately by
+// clock.LagComp.
+const (
+	maxRTTMs = 5000
+	rttTTL   = 2 * time.Minute
+)
+
+func rttKey(matchID, side string) string {
+	return fmt.Sprintf("lag:{%s}:rtt:%s", matchID, side)
+}
+
+// RecordRTT folds one round-trip sample for side of matchID into its
+// running estimate.
+func RecordRTT(ctx context.Context, s *store.Store, matchID, side string, rttMs int) error {
+	rttMs = min(max(rttMs, 0), maxRTTMs)
+	key := rttKey(matchID, side)
+	prev, err := s.Redis.Get(ctx, key).Int()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	if err == nil {
+		rttMs = (3*prev + rttMs) / 4
+	}
+	return s.Redis.Set(ctx, key, strconv.Itoa(rttMs), rttTTL).Err()
+}
+
+// playerRTT is side's current round-trip estimate, 0 when none is known.
+func playerRTT(ctx context.Context, s *store.Store, matchID, side string) int {
+	rtt, err := s.Redis.Get(ctx, rttKey(matchID, side)).Int()
+	if err != nil {
+		return 0
+	}
+	return rtt
+}
+
+// CheckDisplayedClock compares the clocks a client shows against the
+// server's and returns a ClockCorrection when they drifted past tolerance.
+func CheckDisplayedClock(ctx context.Context, s *store.Store, matchID string, msWhite, msBlack int) (*proto.ClockCorrection, error) {
+	st, err := LoadClock(ctx, s, matchID)
+	if err != nil {
+		return nil, err
+	}
+	cc := clockCorrection(matchID, st, time.Now())
+	if !clock.Drifted(msWhite, msBlack, cc.MsWhite, cc.MsBlack) {
+		return nil, nil
+	}
+	return cc, nil
+}
+
+func clockCorrection(matchID string, st *clock.ClockState, now time.Time) *proto.ClockCorrection {
+	w, b := clock.Remaining(st, now)
+	return &proto.ClockCorrection{MatchID: matchID, MsWhite: w, MsBlack: b, SideToMove: st.SideToMove, ServerTime: now.UnixMilli()}
+}
+
+// pushClock sends both seats of m the server's clocks, once an append or
+// the watchdog has found that a client's view of them is off.
+func pushClock(ctx context.Context, s *store.Store, m *matchState) {
+	frame, _ := proto.Encode(proto.ActionClockCorrection, clockCorrection(m.ID, m.clock(), time.Now()))
+	if err := signaling.Publish(ctx, s, m.ID, "", frame); err != nil {
+		log.Printf("clock correction error: %v", err)
+	}
+}
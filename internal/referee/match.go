@@ -0,0 +1,158 @@
+package referee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	chess "github.com/corentings/chess/v2"
+	"github.com/jackc/pgx/v5"
+
+	"p2p-chess/internal/certificate"
+	"p2p-chess/internal/clock"
+	"p2p-chess/internal/engine"
+	"p2p-chess/internal/proto"
+	"p2p-chess/internal/signaling"
+	"p2p-chess/internal/store"
+)
+
+// matchState is the locked row every referee decision is made against.
+type matchState struct {
+	ID          string
+	Status      string
+	LastSeq     int
+	LastFEN     string
+	SideToMove  string
+	MsWhite     int
+	MsBlack     int
+	DrawOfferBy string // empty when no offer is pending
+	ChainHead   string
+	TC          clock.TimeControl
+	MovesWhite  int // completed per side, for the time control's periods
+	MovesBlack  int
+	TickWhite   time.Time // zero until that clock first runs
+	TickBlack   time.Time
+	QuotaWhite  int // lag compensation left, see clock.LagComp
+	QuotaBlack  int
+}
+
+// clock is the server's clock state for m.
+func (m *matchState) clock() *clock.ClockState {
+	return &clock.ClockState{
+		MsWhite:       m.MsWhite,
+		MsBlack:       m.MsBlack,
+		SideToMove:    m.SideToMove,
+		LastTickWhite: m.TickWhite,
+		LastTickBlack: m.TickBlack,
+		TC:            m.TC,
+		MovesWhite:    m.MovesWhite,
+		MovesBlack:    m.MovesBlack,
+	}
+}
+
+// lockMatch loads matchID FOR UPDATE inside tx and fails unless the game is
+// still being played.
+func lockMatch(ctx context.Context, tx pgx.Tx, matchID string) (*matchState, error) {
+	m := &matchState{ID: matchID}
+	var tickWhite, tickBlack *time.Time
+	var tc []byte
+	var baseMs, incMs, delayMs int
+	err := tx.QueryRow(ctx, `
+SELECT status, last_seq, last_fen, side_to_move, ms_white, ms_black, COALESCE(draw_offer_by, ''), COALESCE(chain_head, ''),
+       time_control, tc_base_ms, tc_inc_ms, tc_delay_ms, moves_white, moves_black,
+       tick_white_at, tick_black_at, lag_quota_white_ms, lag_quota_black_ms
+FROM matches WHERE id = $1 FOR UPDATE`, matchID).
+		Scan(&m.Status, &m.LastSeq, &m.LastFEN, &m.SideToMove, &m.MsWhite, &m.MsBlack, &m.DrawOfferBy, &m.ChainHead,
+			&tc, &baseMs, &incMs, &delayMs, &m.MovesWhite, &m.MovesBlack,
+			&tickWhite, &tickBlack, &m.QuotaWhite, &m.QuotaBlack)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMatchNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.Status != "live" && m.Status != "relayed" {
+		return nil, ErrMatchOver
+	}
+	if m.ChainHead == "" {
+		m.ChainHead = ChainGenesis(matchID)
+	}
+	m.TC = timeControl(tc, baseMs, incMs, delayMs)
+	if tickWhite != nil {
+		m.TickWhite = *tickWhite
+	}
+	if tickBlack != nil {
+		m.TickBlack = *tickBlack
+	}
+	return m, nil
+}
+
+// timeControl decodes a match's time_control column, falling back to the
+// single period in its tc_* columns for matches created before it existed.
+func timeControl(raw []byte, baseMs, incMs, delayMs int) clock.TimeControl {
+	var tc clock.TimeControl
+	if raw != nil && json.Unmarshal(raw, &tc) == nil && tc.Validate() == nil {
+		return tc
+	}
+	return clock.SuddenDeath(baseMs, incMs, delayMs)
+}
+
+func (m *matchState) diverged(reason string) error {
+	return &CorrectionError{Correction: proto.Correction{RewindTo: m.LastSeq, Snapshot: m.LastFEN, ChainHead: m.ChainHead, Reason: reason}}
+}
+
+// clockDiverged rejects a move whose declared clocks are off from the
+// server's msWhite/msBlack by more than the drift tolerance.
+func (m *matchState) clockDiverged(msWhite, msBlack int) error {
+	err := m.diverged("clock").(*CorrectionError)
+	err.Correction.MsWhite, err.Correction.MsBlack = &msWhite, &msBlack
+	return err
+}
+
+func finishMatch(ctx context.Context, q store.DBTX, matchID, result, reason string) error {
+	_, err := q.Exec(ctx, "UPDATE matches SET status = 'finished', result = $1, reason = $2, finished_at = NOW(), draw_offer_by = NULL, draw_offer_seq = NULL WHERE id = $3",
+		result, reason, matchID)
+	return err
+}
+
+// afterFinish runs the side effects of a finished match that must wait for
+// its transaction to commit.
+func afterFinish(ctx context.Context, s *store.Store, matchID, result, reason string) {
+	dropClock(ctx, s, matchID)
+	if err := s.UpdateRatings(matchID); err != nil {
+		log.Printf("rating update error: %v", err)
+	}
+	if _, err := certificate.Issue(ctx, s.DB, matchID); err != nil {
+		log.Printf("certificate error: %v", err)
+	}
+	frame, _ := proto.Encode(proto.ActionResult, proto.Result{MatchID: matchID, Result: result, Reason: reason})
+	if err := signaling.Publish(ctx, s, matchID, "", frame); err != nil {
+		log.Printf("result notification error: %v", err)
+	}
+	if err := s.Redis.Publish(ctx, spectateChannel(matchID), frame).Err(); err != nil {
+		log.Printf("result notification error: %v", err)
+	}
+}
+
+// spectateChannel carries live frames to spectator streams of matchID.
+func spectateChannel(matchID string) string {
+	return "spectate:" + matchID
+}
+
+// timeoutResult is the result when flagged runs out of time in fen: a win
+// for the opponent, or a draw if the opponent could never mate.
+func timeoutResult(fen, flagged string) string {
+	if ok, err := engine.CanMate(fen, opponent(flagged)); err == nil && !ok {
+		return string(chess.Draw)
+	}
+	return winFor(opponent(flagged))
+}
+
+func winFor(side string) string {
+	if side == "w" {
+		return "1-0"
+	}
+	return "0-1"
+}
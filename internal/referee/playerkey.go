@@ -0,0 +1,179 @@
+package referee
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+
+	"p2p-chess/internal/matchkey"
+	"p2p-chess/internal/proto"
+	"p2p-chess/internal/store"
+)
+
+var (
+	ErrBadPublicKey   = errors.New("invalid public key")
+	ErrKeyMismatch    = errors.New("a different public key is already registered for this seat")
+	ErrSigAlgMismatch = errors.New("match is signed with a different algorithm")
+)
+
+// eventSig records how an accepted event was signed. KeyGen is only set for
+// HMAC signatures.
+type eventSig struct {
+	Alg    string
+	KeyGen *int
+}
+
+// RegisterPlayerKey binds side's Ed25519 public key (base64) to matchID.
+// A seat keeps its first key for the whole match so every signature it made
+// stays attributable; registering the same key again is a no-op.
+func RegisterPlayerKey(ctx context.Context, q store.DBTX, matchID, side, pubKey string) error {
+	pub, err := base64.StdEncoding.DecodeString(pubKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return ErrBadPublicKey
+	}
+	var stored []byte
+	err = q.QueryRow(ctx, `
+INSERT INTO match_player_keys (match_id, side, pubkey) VALUES ($1, $2, $3)
+ON CONFLICT (match_id, side) DO UPDATE SET match_id = EXCLUDED.match_id
+RETURNING pubkey`, matchID, side, pub).Scan(&stored)
+	if err != nil {
+		return err
+	}
+	if !ed25519.PublicKey(stored).Equal(ed25519.PublicKey(pub)) {
+		return ErrKeyMismatch
+	}
+	return nil
+}
+
+// playerKey returns side's registered public key, or nil if the seat signs
+// with the legacy match key.
+func playerKey(ctx context.Context, q store.DBTX, matchID, side string) (ed25519.PublicKey, error) {
+	var pub []byte
+	err := q.QueryRow(ctx, "SELECT pubkey FROM match_player_keys WHERE match_id = $1 AND side = $2", matchID, side).Scan(&pub)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.PublicKey(pub), nil
+}
+
+// SettleSigAlg decides a match's signature algorithm from what each seat
+// offered at join ("" for a seat that has not joined yet): Ed25519 as soon as
+// either seat offers it, HMAC only once both seats offered HMAC alone. It
+// returns "" while the match is still undecided.
+func SettleSigAlg(offerWhite, offerBlack string) string {
+	switch {
+	case offerWhite == proto.SigAlgEd25519 || offerBlack == proto.SigAlgEd25519:
+		return proto.SigAlgEd25519
+	case offerWhite == proto.SigAlgHMAC && offerBlack == proto.SigAlgHMAC:
+		return proto.SigAlgHMAC
+	}
+	return ""
+}
+
+// NegotiateSigAlg records the capabilities side advertised at join and
+// returns the algorithm its events must be signed with. The match settles on
+// one algorithm once and keeps it; a seat that cannot sign with it is turned
+// away with ErrSigAlgMismatch. Offering Ed25519 registers pubKey.
+func NegotiateSigAlg(ctx context.Context, s *store.Store, matchID, side string, caps []string, pubKey string) (string, error) {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var settled, offerWhite, offerBlack string
+	err = tx.QueryRow(ctx, `
+SELECT COALESCE(sig_alg, ''), COALESCE(sig_offer_white, ''), COALESCE(sig_offer_black, '')
+FROM matches WHERE id = $1 FOR UPDATE`, matchID).Scan(&settled, &offerWhite, &offerBlack)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrMatchNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	offer := proto.SigAlg(caps)
+	alg := settled
+	if alg == "" {
+		if side == "w" {
+			offerWhite = offer
+		} else {
+			offerBlack = offer
+		}
+		alg = SettleSigAlg(offerWhite, offerBlack)
+		_, err := tx.Exec(ctx, "UPDATE matches SET sig_alg = NULLIF($2, ''), sig_offer_white = $3, sig_offer_black = $4 WHERE id = $1",
+			matchID, alg, offerWhite, offerBlack)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	switch {
+	case alg == proto.SigAlgEd25519 && offer != proto.SigAlgEd25519:
+		return "", ErrSigAlgMismatch
+	case alg == proto.SigAlgHMAC && offer != proto.SigAlgHMAC && !slices.Contains(caps, proto.CapSigHMAC):
+		return "", ErrSigAlgMismatch
+	case alg == proto.SigAlgEd25519:
+		if err := RegisterPlayerKey(ctx, tx, matchID, side, pubKey); err != nil {
+			return "", err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+	if alg == "" {
+		return offer, nil
+	}
+	return alg, nil
+}
+
+// CheckPlayerSig verifies a base64 Ed25519 signature over canonical.
+func CheckPlayerSig(pub ed25519.PublicKey, canonical, sig string) error {
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil || !ed25519.Verify(pub, []byte(canonical), raw) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// verifySig checks the signature side attached to an event: against their
+// own public key when they registered one, otherwise against the shared
+// match key. HMAC is refused outright once the match settled on Ed25519, so
+// a seat cannot fall back to a signature its opponent could forge.
+func verifySig(ctx context.Context, q store.DBTX, matchID, side, canonical, sig string) (eventSig, error) {
+	pub, err := playerKey(ctx, q, matchID, side)
+	if err != nil {
+		return eventSig{}, err
+	}
+	if pub != nil {
+		return eventSig{Alg: proto.SigAlgEd25519}, CheckPlayerSig(pub, canonical, sig)
+	}
+	var alg string
+	if err := q.QueryRow(ctx, "SELECT COALESCE(sig_alg, '') FROM matches WHERE id = $1", matchID).Scan(&alg); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return eventSig{}, ErrMatchNotFound
+		}
+		return eventSig{}, err
+	}
+	if alg == proto.SigAlgEd25519 {
+		return eventSig{}, ErrSigAlgMismatch
+	}
+
+	keyGen, err := matchkey.Verify(ctx, q, matchID, canonical, sig)
+	switch {
+	case errors.Is(err, matchkey.ErrBadSignature):
+		return eventSig{}, ErrBadSignature
+	case errors.Is(err, matchkey.ErrNoKey):
+		return eventSig{}, ErrMatchNotFound
+	case err != nil:
+		return eventSig{}, err
+	}
+	return eventSig{Alg: proto.SigAlgHMAC, KeyGen: &keyGen}, nil
+}
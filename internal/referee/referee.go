@@ -1,17 +1,20 @@
 package referee
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"time"
 
-	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
 
 	"p2p-chess/internal/clock"
+	"p2p-chess/internal/engine"
+	"p2p-chess/internal/proto"
 	"p2p-chess/internal/store"
 
 	chess "github.com/corentings/chess/v2"
@@ -56,15 +59,24 @@ func ValidateMove(fen, uci string) (string, error) {
 	return res.NewFEN, nil
 }
 
+// ComputeZobrist is the Polyglot key of fen as stored in match_events.zobrist.
+// It returns "" for a FEN the engine cannot parse.
 func ComputeZobrist(fen string) string {
-	hash := sha256.Sum256([]byte(fen))
-	return hex.EncodeToString(hash[:])
+	z, err := engine.ZobristHex(fen)
+	if err != nil {
+		return ""
+	}
+	return z
 }
 
-// TODO: If library has built-in Zobrist, use that instead
-
 // TODO: Full adjudication, clocks, outcomes
 
+// MoveCanonical is what a move signature covers: seq|uci|fen|msW|msB, with
+// the FEN and clocks as the client reported them.
+func MoveCanonical(seq int, uci, fen string, msWhite, msBlack int) string {
+	return fmt.Sprintf("%d|%s|%s|%d|%d", seq, uci, fen, msWhite, msBlack)
+}
+
 type AppendRequest struct {
 	Seq      int    `json:"seq"`
 	UCI      string `json:"uci"`
@@ -74,105 +86,266 @@ type AppendRequest struct {
 	TsClient string `json:"tsClient"`
 	Side     string `json:"side"`
 	Sig      string `json:"sig"`
+	PrevHash string `json:"prevHash"`
 }
 
-func AppendHandler(w http.ResponseWriter, r *http.Request) {
-	matchID := chi.URLParam(r, "id")
-	var req AppendRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
+var (
+	ErrBadSignature = errors.New("invalid signature")
+	ErrIllegalMove  = errors.New("invalid move")
+	ErrBadTimestamp = errors.New("invalid timestamp")
+	ErrTimeout      = errors.New("timeout")
+)
+
+type AppendResult struct {
+	Seq     int
+	Hash    string
+	FEN     string
+	MsWhite int
+	MsBlack int
+	LagComp int // ms credited back to the mover
+	Outcome chess.Outcome
+	Method  chess.Method
+}
+
+// CorrectionError rejects an event that does not follow on from the
+// authoritative position; the client should rewind to the correction.
+type CorrectionError struct {
+	Correction proto.Correction
+}
+
+func (e *CorrectionError) Error() string {
+	return "diverged from server: " + e.Correction.Reason
+}
+
+// recordCorrection files the signature of an event rejected by ce at the
+// match's next seq. The player signs that seq again after rewinding, and a
+// dispute must not hold the two versions against them.
+func recordCorrection(ctx context.Context, q store.DBTX, m *matchState, side string, seq int, sig string, ce *CorrectionError) error {
+	if seq != m.LastSeq+1 || sig == "" {
+		return nil
 	}
-	// TODO: Fetch matchKey from Redis or DB
-	matchKey := []byte("placeholder_key")
+	_, err := q.Exec(ctx, "INSERT INTO match_corrections (match_id, seq, side, reason, sig) VALUES ($1, $2, $3, $4, $5)",
+		m.ID, seq, side, ce.Correction.Reason, sig)
+	return err
+}
 
-	// Verify sig = HMAC-SHA256(matchKey, canonical(seq|uci|fen|msW|msB))
-	canonical := fmt.Sprintf("%d|%s|%s|%d|%d", req.Seq, req.UCI, req.FEN, req.MsWhite, req.MsBlack)
-	computedSig := hmac.New(sha256.New, matchKey)
-	computedSig.Write([]byte(canonical))
-	expectedSig := hex.EncodeToString(computedSig.Sum(nil))
-	if req.Sig != expectedSig {
-		http.Error(w, "Invalid signature", http.StatusUnauthorized)
-		return
+// commitCorrection records err in tx and commits it when err is a
+// correction, so the record outlives the rejected event. It returns err.
+func commitCorrection(ctx context.Context, tx pgx.Tx, m *matchState, side string, seq int, sig string, err error) error {
+	var ce *CorrectionError
+	if !errors.As(err, &ce) {
+		return err
+	}
+	if rerr := recordCorrection(ctx, tx, m, side, seq, sig, ce); rerr != nil {
+		log.Printf("correction record error: %v", rerr)
+		return err
 	}
+	if cerr := tx.Commit(ctx); cerr != nil {
+		log.Printf("correction record error: %v", cerr)
+	}
+	return err
+}
 
-	// Validate move
-	result, err := ValidateMoveWithOutcome(req.FEN, req.UCI)
-	if err != nil || !result.Valid {
-		// TODO: Emit correction via WS
-		http.Error(w, "Invalid move", http.StatusBadRequest)
-		return
+// Append runs one signed move through the referee and records it. The
+// position and seq come from the locked match row, never from the client;
+// the client's FEN is only cross-checked. It backs both the HTTP mirror
+// endpoint and moves relayed over the signaling socket.
+func Append(ctx context.Context, s *store.Store, matchID string, req AppendRequest) (*AppendResult, error) {
+	tsClient, err := time.Parse(time.RFC3339, req.TsClient)
+	if err != nil {
+		return nil, ErrBadTimestamp
 	}
 
-	s, err := store.New()
+	tx, err := s.DB.Begin(ctx)
 	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
+	defer tx.Rollback(ctx)
 
-	tsClientTime, err := time.Parse(time.RFC3339, req.TsClient)
+	m, err := lockMatch(ctx, tx, matchID)
 	if err != nil {
-		http.Error(w, "Invalid timestamp", http.StatusBadRequest)
-		return
+		return nil, err
+	}
+	res, err := applyMove(ctx, tx, m, req, tsClient, time.Now(), playerRTT(ctx, s, matchID, req.Side))
+	if errors.Is(err, ErrTimeout) {
+		if err := tx.Commit(ctx); err != nil {
+			return nil, err
+		}
+		afterFinish(ctx, s, matchID, timeoutResult(m.LastFEN, req.Side), "timeout")
+		return nil, ErrTimeout
+	}
+	if err != nil {
+		err = commitCorrection(ctx, tx, m, req.Side, req.Seq, req.Sig, err)
+		var ce *CorrectionError
+		if errors.As(err, &ce) && ce.Correction.Reason == "clock" {
+			pushClock(ctx, s, m)
+		}
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	if res.Outcome != chess.NoOutcome {
+		afterFinish(ctx, s, matchID, string(res.Outcome), res.Method.String())
+	} else {
+		cacheClock(ctx, s, m)
 	}
-	tsServer := time.Now()
+	return res, nil
+}
 
-	// TODO: Fetch current clock state from DB or Redis
-	clockState := &clock.ClockState{
-		MsWhite:    req.MsWhite,
-		MsBlack:    req.MsBlack,
-		SideToMove: req.Side, // assuming
-		// LastTicks, Inc, Delay from match
+// applyMove checks req against m and records it in tx, charging the mover's
+// clock at the instant at less lag compensation for a round trip of rttMs.
+// On success m is advanced to the new position. A
+// flag fall finishes the match in tx and returns ErrTimeout; the caller
+// still has to commit.
+func applyMove(ctx context.Context, tx pgx.Tx, m *matchState, req AppendRequest, tsClient, at time.Time, rttMs int) (*AppendResult, error) {
+	if req.Seq != m.LastSeq+1 {
+		return nil, m.diverged("seq")
+	}
+	if req.Side != m.SideToMove {
+		return nil, m.diverged("turn")
+	}
+	if req.FEN != "" && req.FEN != m.LastFEN {
+		return nil, m.diverged("position")
+	}
+	if err := m.checkChain(req.PrevHash); err != nil {
+		return nil, err
 	}
 
-	newWhite, newBlack, err := clock.UpdateClocks(clockState, req.Side, tsServer, tsClientTime)
+	canonical := MoveCanonical(req.Seq, req.UCI, req.FEN, req.MsWhite, req.MsBlack)
+	sig, err := verifySig(ctx, tx, m.ID, req.Side, canonical, req.Sig)
 	if err != nil {
-		reason := "timeout"
-		resultStr := ""
-		if req.Side == "w" {
-			resultStr = "0-1"
-		} else {
-			resultStr = "1-0"
+		return nil, err
+	}
+
+	// Validate move against the authoritative position
+	result, err := ValidateMoveWithOutcome(m.LastFEN, req.UCI)
+	if err != nil || !result.Valid {
+		return nil, m.diverged("illegal move")
+	}
+
+	// The server's clocks are authoritative; the client's declared values
+	// only have to agree with them.
+	clockState := m.clock()
+	tick, quota := m.TickWhite, m.QuotaWhite
+	if req.Side == "b" {
+		tick, quota = m.TickBlack, m.QuotaBlack
+	}
+	elapsed := clock.CalculateElapsed(tick, at)
+	clockState.LagCompMs, quota = clock.LagComp(rttMs, int(elapsed), quota)
+	newWhite, newBlack, err := clock.UpdateClocks(clockState, req.Side, at, tsClient)
+	if err != nil {
+		if err := finishMatch(ctx, tx, m.ID, timeoutResult(m.LastFEN, req.Side), "timeout"); err != nil {
+			return nil, err
 		}
-		_, _ = s.DB.Exec(r.Context(), "UPDATE matches SET status = 'finished', result = $1, reason = $2, finished_at = NOW() WHERE id = $3", resultStr, reason, matchID)
-		// Notify
-		http.Error(w, "Timeout", http.StatusBadRequest)
-		return
+		m.Status = "finished"
+		return nil, ErrTimeout
+	}
+	if clock.Drifted(req.MsWhite, req.MsBlack, newWhite, newBlack) {
+		return nil, m.clockDiverged(newWhite, newBlack)
 	}
-	payload, _ := json.Marshal(map[string]interface{}{"uci": req.UCI, "fen_before": req.FEN, "fen_after": result.NewFEN, "msW": newWhite, "msB": newBlack})
+	// "signed" keeps the client's values exactly as covered by sig so the
+	// event can be re-verified on replay.
+	payload, _ := json.Marshal(map[string]interface{}{
+		"uci": req.UCI, "fen_before": m.LastFEN, "fen_after": result.NewFEN, "msW": newWhite, "msB": newBlack,
+		"signed": signedMove{FEN: req.FEN, MsWhite: req.MsWhite, MsBlack: req.MsBlack},
+	})
 
 	zobrist := ComputeZobrist(result.NewFEN)
+	hash := EventHash(m.ChainHead, "move", canonical, req.Sig)
 
-	// Insert and update with zobrist used
-	_, err = s.DB.Exec(r.Context(), "INSERT INTO match_events (match_id, seq, type, payload, side, ts_client, ts_server, zobrist, sig, valid) VALUES ($1, $2, 'move', $3, $4, $5, NOW(), $6, $7, true)",
-		matchID, req.Seq, payload, req.Side, req.TsClient, zobrist, req.Sig)
+	_, err = tx.Exec(ctx, "INSERT INTO match_events (match_id, seq, type, payload, side, ts_client, ts_server, zobrist, sig, valid, key_generation, sig_alg, prev_hash, hash, lag_comp_ms) VALUES ($1, $2, 'move', $3, $4, $5, NOW(), $6, $7, true, $8, $9, $10, $11, $12)",
+		m.ID, req.Seq, payload, req.Side, tsClient, zobrist, req.Sig, sig.KeyGen, sig.Alg, m.ChainHead, hash, clockState.LagCompMs)
 	if err != nil {
-		http.Error(w, "DB error", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("insert event: %w", err)
 	}
 
-	// Update matches with new clocks
-	_, err = s.DB.Exec(r.Context(), "UPDATE matches SET last_seq = $1, last_fen = $2, ms_white = $3, ms_black = $4, side_to_move = CASE WHEN side_to_move = 'w' THEN 'b' ELSE 'w' END WHERE id = $5",
-		req.Seq, result.NewFEN, newWhite, newBlack, matchID)
+	if req.Side == "w" {
+		m.QuotaWhite = quota
+	} else {
+		m.QuotaBlack = quota
+	}
+	// A move also lapses any draw offer still on the table.
+	_, err = tx.Exec(ctx, `
+UPDATE matches SET last_seq = $1, last_fen = $2, ms_white = $3, ms_black = $4, side_to_move = $5,
+       draw_offer_by = NULL, draw_offer_seq = NULL, chain_head = $6, tick_white_at = $7, tick_black_at = $8,
+       lag_quota_white_ms = $9, lag_quota_black_ms = $10, moves_white = $11, moves_black = $12
+WHERE id = $13`,
+		req.Seq, result.NewFEN, newWhite, newBlack, opponent(req.Side), hash, clockState.LastTickWhite, clockState.LastTickBlack,
+		m.QuotaWhite, m.QuotaBlack, clockState.MovesWhite, clockState.MovesBlack, m.ID)
 	if err != nil {
-		http.Error(w, "DB update error", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("update match: %w", err)
+	}
+
+	// The engine sees one move at a time, so fivefold repetition has to be
+	// judged from the event log.
+	if result.Outcome == chess.NoOutcome {
+		n, err := repetitions(ctx, tx, m.ID, zobrist)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 5 {
+			result.Outcome, result.Method = chess.Draw, chess.FivefoldRepetition
+		}
 	}
 
 	// Check for terminal state
 	if result.Outcome != chess.NoOutcome {
-		// Update status, result, reason
-		reason := string(result.Method)
-		resultStr := string(result.Outcome)
-		_, err = s.DB.Exec(r.Context(), "UPDATE matches SET status = 'finished', result = $1, reason = $2, finished_at = NOW() WHERE id = $3", resultStr, reason, matchID)
-		if err == nil {
-			// Fetch white and black IDs
-			var whiteID, blackID string
-			err = s.DB.QueryRow(r.Context(), "SELECT side_white, side_black FROM matches WHERE id = $1", matchID).Scan(&whiteID, &blackID)
-			if err == nil {
-				s.UpdateRatings(matchID) // Already fetches, but ensure
-			}
+		if err := finishMatch(ctx, tx, m.ID, string(result.Outcome), result.Method.String()); err != nil {
+			return nil, fmt.Errorf("finish match: %w", err)
 		}
+		m.Status = "finished"
+	}
+
+	m.LastSeq, m.LastFEN, m.SideToMove = req.Seq, result.NewFEN, opponent(req.Side)
+	m.MsWhite, m.MsBlack = newWhite, newBlack
+	m.TickWhite, m.TickBlack = clockState.LastTickWhite, clockState.LastTickBlack
+	m.MovesWhite, m.MovesBlack = clockState.MovesWhite, clockState.MovesBlack
+	m.DrawOfferBy, m.ChainHead = "", hash
+
+	return &AppendResult{
+		Seq:     req.Seq,
+		Hash:    hash,
+		FEN:     result.NewFEN,
+		MsWhite: newWhite,
+		MsBlack: newBlack,
+		LagComp: clockState.LagCompMs,
+		Outcome: result.Outcome,
+		Method:  result.Method,
+	}, nil
+}
+
+func opponent(side string) string {
+	if side == "w" {
+		return "b"
+	}
+	return "w"
+}
+
+func AppendHandler(w http.ResponseWriter, r *http.Request) {
+	matchID := chi.URLParam(r, "id")
+	var req AppendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	s, err := store.New()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// The seat decides the side; whatever the client put in req.Side is ignored.
+	side, ok := AuthorizeSeat(w, r, s, matchID)
+	if !ok {
+		return
+	}
+	req.Side = side
+
+	if _, err := Append(r.Context(), s, matchID, req); err != nil {
+		writeError(w, err)
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -181,14 +354,24 @@ func AppendHandler(w http.ResponseWriter, r *http.Request) {
 
 func SpectateHandler(w http.ResponseWriter, r *http.Request) {
 	matchID := chi.URLParam(r, "id")
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
 
 	s, err := store.New()
 	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
+	if status, ok := canSpectate(r, s, matchID); !ok {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	// Subscribe before replaying so a result published meanwhile is not lost.
+	sub := s.Redis.Subscribe(r.Context(), spectateChannel(matchID))
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
 
 	rows, err := s.DB.Query(r.Context(), "SELECT seq, type, payload FROM match_events WHERE match_id = $1 ORDER BY seq", matchID)
 	if err != nil {
@@ -211,6 +394,25 @@ func SpectateHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "data: %s\n\n", payload)
 		flusher.Flush()
 	}
+	rows.Close()
 
-	// TODO: Tail for live updates using pub/sub or polling
+	var status string
+	if err := s.DB.QueryRow(r.Context(), "SELECT status FROM matches WHERE id = $1", matchID).Scan(&status); err != nil || status == "finished" {
+		return
+	}
+
+	// TODO: Tail moves as well; for now only the result is pushed live.
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg, ok := <-sub.Channel():
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "event: result\ndata: %s\n\n", msg.Payload)
+			flusher.Flush()
+			return
+		}
+	}
 }
@@ -3,8 +3,13 @@
 package referee_test
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"p2p-chess/internal/clock"
+	"p2p-chess/internal/proto"
 	"p2p-chess/internal/referee"
 	"testing"
+	"time"
 
 	chess "github.com/corentings/chess/v2"
 	"github.com/stretchr/testify/assert"
@@ -34,5 +39,222 @@ func TestCheckmateOutcome(t *testing.T) {
 	assert.Equal(t, chess.Checkmate, result.Method)
 }
 
+func TestCheckPlayerSig(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	canonical := referee.MoveCanonical(1, "e2e4", "", 300000, 300000)
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(canonical)))
+
+	assert.NoError(t, referee.CheckPlayerSig(pub, canonical, sig))
+	assert.ErrorIs(t, referee.CheckPlayerSig(pub, referee.MoveCanonical(1, "e2e4", "", 300000, 299000), sig), referee.ErrBadSignature)
+	assert.ErrorIs(t, referee.CheckPlayerSig(pub, canonical, "not base64!"), referee.ErrBadSignature)
+}
+
+func TestSettleSigAlg(t *testing.T) {
+	cases := []struct {
+		name         string
+		white, black string
+		want         string
+	}{
+		{"nobody joined", "", "", ""},
+		{"one hmac seat waits for the other", proto.SigAlgHMAC, "", ""},
+		{"both hmac", proto.SigAlgHMAC, proto.SigAlgHMAC, proto.SigAlgHMAC},
+		{"first ed25519 seat settles it", "", proto.SigAlgEd25519, proto.SigAlgEd25519},
+		{"ed25519 beats hmac", proto.SigAlgHMAC, proto.SigAlgEd25519, proto.SigAlgEd25519},
+		{"both ed25519", proto.SigAlgEd25519, proto.SigAlgEd25519, proto.SigAlgEd25519},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, referee.SettleSigAlg(c.white, c.black))
+		})
+	}
+}
+
+func TestEventHashChain(t *testing.T) {
+	genesis := referee.ChainGenesis("m1")
+	assert.NotEqual(t, genesis, referee.ChainGenesis("m2"))
+
+	h1 := referee.EventHash(genesis, "move", referee.MoveCanonical(1, "e2e4", "", 0, 0), "s1")
+	h2 := referee.EventHash(h1, "move", referee.MoveCanonical(2, "e7e5", "", 0, 0), "s2")
+	assert.Equal(t, h2, referee.EventHash(h1, "move", referee.MoveCanonical(2, "e7e5", "", 0, 0), "s2"))
+
+	// Dropping or reordering an event changes every later link.
+	assert.NotEqual(t, h2, referee.EventHash(genesis, "move", referee.MoveCanonical(2, "e7e5", "", 0, 0), "s2"))
+	assert.NotEqual(t, h1, referee.EventHash(genesis, "resign", referee.MoveCanonical(1, "e2e4", "", 0, 0), "s1"))
+}
+
+func TestAdjudicate(t *testing.T) {
+	e4 := referee.LogEntry{Seq: 1, Type: "move", Side: "w", UCI: "e2e4", Sig: "w1"}
+	e5 := referee.LogEntry{Seq: 2, Type: "move", Side: "b", UCI: "e7e5", Sig: "b2"}
+	c5 := referee.LogEntry{Seq: 2, Type: "move", Side: "b", UCI: "c7c5", Sig: "b2'"}
+	own := func(referee.LogEntry) referee.SigCheck { return referee.SigOwn }
+	shared := func(referee.LogEntry) referee.SigCheck { return referee.SigShared }
+	server := []referee.LogEntry{e4, e5}
+
+	v := referee.Adjudicate(server, map[string][]referee.LogEntry{"w": {e4, e5}}, nil, own)
+	assert.Equal(t, referee.DecisionRewind, v.Decision)
+
+	// White never saw the server's record of e5 and holds black's own
+	// signature on c5 for the same seq: black equivocated.
+	v = referee.Adjudicate(server, map[string][]referee.LogEntry{"w": {e4, c5}}, nil, own)
+	assert.Equal(t, referee.DecisionForfeit, v.Decision)
+	assert.Equal(t, "b", v.Forfeits)
+
+	// With the shared match key either player could have made c5.
+	v = referee.Adjudicate(server, map[string][]referee.LogEntry{"w": {e4, c5}}, nil, shared)
+	assert.Equal(t, referee.DecisionRewind, v.Decision)
+	assert.Contains(t, v.Reason, "seq 2")
+
+	v = referee.Adjudicate(server, map[string][]referee.LogEntry{"b": {e4, e5}}, nil, func(e referee.LogEntry) referee.SigCheck {
+		if e.Sig == "b2" {
+			return referee.SigInvalid
+		}
+		return referee.SigOwn
+	})
+	assert.Equal(t, referee.DecisionRejected, v.Decision)
+
+	v = referee.Adjudicate(server, map[string][]referee.LogEntry{"w": {e5}}, nil, own)
+	assert.Equal(t, referee.DecisionRejected, v.Decision)
+
+	// Black's c5 was turned down with a correction and black re-signed seq
+	// 2 as told; white's copy of the rejected move is no equivocation.
+	v = referee.Adjudicate(server, map[string][]referee.LogEntry{"w": {e4, c5}}, map[string]bool{"b2'": true}, own)
+	assert.Equal(t, referee.DecisionRewind, v.Decision)
+	assert.Contains(t, v.Reason, "seq 2")
+
+	// A correction on some other signature does not excuse c5.
+	v = referee.Adjudicate(server, map[string][]referee.LogEntry{"w": {e4, c5}}, map[string]bool{"w1": true}, own)
+	assert.Equal(t, referee.DecisionForfeit, v.Decision)
+
+	// Both players hold e5 past the server's e4: it extends the line.
+	v = referee.Adjudicate([]referee.LogEntry{e4}, map[string][]referee.LogEntry{"w": {e4, e5}, "b": {e4, e5}}, nil, own)
+	assert.Equal(t, referee.DecisionRewind, v.Decision)
+	assert.Equal(t, []referee.LogEntry{e5}, v.Extend)
+
+	// Only the prefix both logs agree on extends it.
+	nf3 := referee.LogEntry{Seq: 3, Type: "move", Side: "w", UCI: "g1f3", Sig: "w3"}
+	v = referee.Adjudicate([]referee.LogEntry{e4}, map[string][]referee.LogEntry{"w": {e4, e5, nf3}, "b": {e4, e5}}, nil, own)
+	assert.Equal(t, []referee.LogEntry{e5}, v.Extend)
+	assert.Contains(t, v.Reason, "seq 3")
+
+	// Logs that disagree past the server extend nothing.
+	v = referee.Adjudicate([]referee.LogEntry{e4}, map[string][]referee.LogEntry{"w": {e4, e5}, "b": {e4, c5}}, nil, shared)
+	assert.Equal(t, referee.DecisionRewind, v.Decision)
+	assert.Empty(t, v.Extend)
+	assert.Contains(t, v.Reason, "seq 2")
+}
+
+func TestRunBatch(t *testing.T) {
+	floor := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := floor.Add(10 * time.Second)
+	mv := func(seq int, ts time.Time) referee.AppendRequest {
+		return referee.AppendRequest{Seq: seq, UCI: "e2e4", TsClient: ts.Format(time.RFC3339)}
+	}
+	acc, rej, skip := referee.BatchAccepted, referee.BatchRejected, referee.BatchSkipped
+
+	cases := []struct {
+		name          string
+		toMove        string
+		opponentKeyed bool
+		moves         []referee.AppendRequest
+		reject, mate  int // seq apply turns down or ends the game on
+		want          []string
+		wantAt        []time.Time // instants apply charged the clocks at
+	}{
+		{"all accepted", "w", true,
+			[]referee.AppendRequest{mv(1, floor.Add(2*time.Second)), mv(2, floor.Add(4*time.Second))}, 0, 0,
+			[]string{acc, acc}, []time.Time{floor.Add(2 * time.Second), floor.Add(4 * time.Second)}},
+		{"stops at the first rejection", "w", true,
+			[]referee.AppendRequest{mv(1, floor), mv(2, floor), mv(3, floor)}, 2, 0,
+			[]string{acc, rej, skip}, []time.Time{floor, floor}},
+		{"opponent move without own key", "w", false,
+			[]referee.AppendRequest{mv(1, floor), mv(2, floor), mv(3, floor)}, 0, 0,
+			[]string{acc, rej, skip}, []time.Time{floor}},
+		{"opponent move first without own key", "b", false,
+			[]referee.AppendRequest{mv(1, floor), mv(2, floor)}, 0, 0,
+			[]string{rej, skip}, nil},
+		{"bad timestamp", "w", true,
+			[]referee.AppendRequest{{Seq: 1, TsClient: "yesterday"}, mv(2, floor)}, 0, 0,
+			[]string{rej, skip}, nil},
+		{"moves after mate skipped", "w", true,
+			[]referee.AppendRequest{mv(1, floor), mv(2, floor)}, 0, 1,
+			[]string{acc, skip}, []time.Time{floor}},
+		{"ts before the last event clamped up", "w", true,
+			[]referee.AppendRequest{mv(1, floor.Add(-time.Minute))}, 0, 0,
+			[]string{acc}, []time.Time{floor}},
+		{"ts after receipt clamped down", "w", true,
+			[]referee.AppendRequest{mv(1, floor.Add(time.Hour))}, 0, 0,
+			[]string{acc}, []time.Time{now}},
+		{"ts before the previous move clamped to it", "w", true,
+			[]referee.AppendRequest{mv(1, floor.Add(5*time.Second)), mv(2, floor.Add(3*time.Second))}, 0, 0,
+			[]string{acc, acc}, []time.Time{floor.Add(5 * time.Second), floor.Add(5 * time.Second)}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var at []time.Time
+			apply := func(req referee.AppendRequest, _, when time.Time) (*referee.AppendResult, error) {
+				at = append(at, when)
+				if req.Seq == c.reject {
+					return nil, &referee.CorrectionError{Correction: proto.Correction{RewindTo: req.Seq - 1, Reason: "illegal move"}}
+				}
+				res := &referee.AppendResult{Seq: req.Seq, Outcome: chess.NoOutcome}
+				if req.Seq == c.mate {
+					res.Outcome, res.Method = chess.WhiteWon, chess.Checkmate
+				}
+				return res, nil
+			}
+
+			out, err := referee.RunBatch("m1", "w", c.toMove, referee.StartFEN, c.opponentKeyed, c.moves, floor, now, apply)
+			assert.NoError(t, err)
+			var got []string
+			for _, m := range out.Moves {
+				got = append(got, m.Status)
+			}
+			assert.Equal(t, c.want, got)
+			assert.Equal(t, c.wantAt, at)
+			assert.Equal(t, c.reject > 0, out.Correction != nil)
+			assert.Equal(t, c.mate > 0, out.Result != nil)
+		})
+	}
+}
+
 // Clock tests
 // ...
+
+func TestCheckClocks(t *testing.T) {
+	blitz := clock.Fischer(180000, 2000)
+	hourglass := clock.TimeControl{Mode: clock.ModeHourglass, Periods: []clock.Period{{BaseMs: 60000}}}
+	fide := clock.TimeControl{Mode: clock.ModeFischer, Periods: []clock.Period{
+		{Moves: 40, BaseMs: 90 * 60000, IncMs: 30000},
+		{BaseMs: 30 * 60000, IncMs: 30000},
+	}}
+
+	cases := []struct {
+		name               string
+		tc                 clock.TimeControl
+		side               string
+		n                  int
+		prevW, prevB, w, b int
+		wantIssue          bool
+	}{
+		{"fischer move within credit", blitz, "w", 1, 180000, 180000, 181000, 180000, false},
+		{"waiting clock moved", blitz, "w", 1, 180000, 180000, 179000, 179500, true},
+		{"black's waiting clock moved", blitz, "b", 1, 180000, 180000, 180500, 179000, true},
+		{"mover gained more than credit", blitz, "w", 1, 180000, 180000, 182500, 180000, true},
+		{"negative clock", blitz, "b", 3, 5000, 1000, 5000, -5, true},
+		{"hourglass transfer", hourglass, "w", 1, 60000, 60000, 58000, 62000, false},
+		{"hourglass transfer mismatch", hourglass, "w", 1, 60000, 60000, 58000, 61000, true},
+		{"period boundary credit", fide, "w", 40, 100000, 500000, 100000 + 30*60000 + 29000, 500000, false},
+		{"period credit before the boundary", fide, "w", 39, 100000, 500000, 100000 + 30*60000 + 29000, 500000, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			issue := referee.CheckClocks(c.tc, c.side, c.n, c.prevW, c.prevB, c.w, c.b)
+			if c.wantIssue {
+				assert.NotEmpty(t, issue)
+			} else {
+				assert.Empty(t, issue)
+			}
+		})
+	}
+}
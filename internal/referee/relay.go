@@ -0,0 +1,57 @@
+package referee
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+
+	"p2p-chess/internal/proto"
+	"p2p-chess/internal/store"
+)
+
+var (
+	ErrMatchNotFound = errors.New("match not found")
+	ErrNotRelayed    = errors.New("match is not relayed")
+	ErrMatchOver     = errors.New("match is not in progress")
+	ErrBadSeq        = errors.New("unexpected seq")
+	ErrWrongSide     = errors.New("wrong side")
+)
+
+// SwitchToRelayed moves a live match onto the server relay. It is idempotent
+// so both players may ask; the snapshot tells them which seq comes next.
+func SwitchToRelayed(ctx context.Context, s *store.Store, matchID string) (*proto.Relayed, error) {
+	snap := &proto.Relayed{MatchID: matchID}
+	var status string
+	err := s.DB.QueryRow(ctx, `
+UPDATE matches SET status = 'relayed'
+WHERE id = $1 AND status IN ('live', 'relayed')
+RETURNING status, last_seq, last_fen, side_to_move, ms_white, ms_black, COALESCE(chain_head, '')`, matchID).
+		Scan(&status, &snap.LastSeq, &snap.FEN, &snap.SideToMove, &snap.MsWhite, &snap.MsBlack, &snap.ChainHead)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMatchOver
+	}
+	if err != nil {
+		return nil, err
+	}
+	if snap.ChainHead == "" {
+		snap.ChainHead = ChainGenesis(matchID)
+	}
+	return snap, nil
+}
+
+// RequireRelayed fails unless matchID is currently in relayed mode.
+func RequireRelayed(ctx context.Context, s *store.Store, matchID string) error {
+	var status string
+	err := s.DB.QueryRow(ctx, "SELECT status FROM matches WHERE id = $1", matchID).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrMatchNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status != "relayed" {
+		return ErrNotRelayed
+	}
+	return nil
+}
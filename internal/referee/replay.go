@@ -0,0 +1,292 @@
+package referee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"p2p-chess/internal/clock"
+	"p2p-chess/internal/matchkey"
+	"p2p-chess/internal/proto"
+	"p2p-chess/internal/store"
+)
+
+// signedMove is the part of a move payload the client signed.
+type signedMove struct {
+	FEN     string `json:"fen"`
+	MsWhite int    `json:"msW"`
+	MsBlack int    `json:"msB"`
+}
+
+type movePayload struct {
+	UCI       string      `json:"uci"`
+	FENBefore string      `json:"fen_before"`
+	FENAfter  string      `json:"fen_after"`
+	MsWhite   int         `json:"msW"`
+	MsBlack   int         `json:"msB"`
+	Signed    *signedMove `json:"signed"`
+}
+
+// ReplayIssue is the first inconsistency found in a match log.
+type ReplayIssue struct {
+	Seq    int    `json:"seq"`
+	Check  string `json:"check"`
+	Detail string `json:"detail"`
+}
+
+func (i *ReplayIssue) String() string {
+	return fmt.Sprintf("seq %d: %s: %s", i.Seq, i.Check, i.Detail)
+}
+
+// ReplayReport is the outcome of ReplayMatch. Issue is nil when the log is
+// consistent.
+type ReplayReport struct {
+	MatchID string       `json:"matchId"`
+	Events  int          `json:"events"`
+	FEN     string       `json:"fen"`
+	Issue   *ReplayIssue `json:"issue,omitempty"`
+}
+
+func (r *ReplayReport) OK() bool { return r.Issue == nil }
+
+// ReplayMatch rebuilds matchID from its event log: every move is replayed
+// through the engine from the starting position and every event has its
+// seq, signature, zobrist key, clocks and chain link re-checked. It stops at the first
+// inconsistency; the returned error only reports failures to read the log.
+func ReplayMatch(ctx context.Context, q store.DBTX, matchID string) (*ReplayReport, error) {
+	var lastSeq, baseMs, incMs, delayMs int
+	var lastFEN, startFEN, chainHead string
+	var rawTC []byte
+	err := q.QueryRow(ctx, "SELECT last_seq, last_fen, COALESCE(start_fen, $2), time_control, tc_base_ms, tc_inc_ms, tc_delay_ms, COALESCE(chain_head, '') FROM matches WHERE id = $1", matchID, StartFEN).
+		Scan(&lastSeq, &lastFEN, &startFEN, &rawTC, &baseMs, &incMs, &delayMs, &chainHead)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMatchNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query(ctx, `
+SELECT seq, type, payload, COALESCE(side, ''), ts_server, zobrist, sig, key_generation, sig_alg, COALESCE(prev_hash, ''), COALESCE(hash, '')
+FROM match_events WHERE match_id = $1 ORDER BY seq`, matchID)
+	if err != nil {
+		return nil, err
+	}
+	type event struct {
+		seq      int
+		typ      string
+		payload  []byte
+		side     string
+		tsServer time.Time
+		zobrist  string
+		sig      []byte
+		keyGen   *int
+		sigAlg   string
+		prevHash string
+		hash     string
+	}
+	var events []event
+	for rows.Next() {
+		var e event
+		if err := rows.Scan(&e.seq, &e.typ, &e.payload, &e.side, &e.tsServer, &e.zobrist, &e.sig, &e.keyGen, &e.sigAlg, &e.prevHash, &e.hash); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rep := &ReplayReport{MatchID: matchID, Events: len(events), FEN: startFEN}
+	flag := func(seq int, check, format string, args ...any) (*ReplayReport, error) {
+		rep.Issue = &ReplayIssue{Seq: seq, Check: check, Detail: fmt.Sprintf(format, args...)}
+		return rep, nil
+	}
+
+	tc := timeControl(rawTC, baseMs, incMs, delayMs)
+	msWhite, msBlack := tc.InitialMs(), tc.InitialMs()
+	moves := map[string]int{}
+	head := ChainGenesis(matchID)
+	var prevTs time.Time
+	for i, e := range events {
+		if e.seq != i+1 {
+			return flag(e.seq, "seq", "expected %d", i+1)
+		}
+		if e.tsServer.Before(prevTs) {
+			return flag(e.seq, "timestamp", "server time went backwards")
+		}
+		prevTs = e.tsServer
+
+		var canonical string
+		switch e.typ {
+		case "move":
+			var p movePayload
+			if err := json.Unmarshal(e.payload, &p); err != nil {
+				return flag(e.seq, "payload", "%v", err)
+			}
+			if p.FENBefore != rep.FEN {
+				return flag(e.seq, "position", "recorded %q, replayed %q", p.FENBefore, rep.FEN)
+			}
+			res, err := ValidateMoveWithOutcome(rep.FEN, p.UCI)
+			if err != nil || !res.Valid {
+				return flag(e.seq, "move", "illegal move %s", p.UCI)
+			}
+			if res.NewFEN != p.FENAfter {
+				return flag(e.seq, "position", "recorded %q after %s, replayed %q", p.FENAfter, p.UCI, res.NewFEN)
+			}
+			if e.side != sideOf(rep.FEN) {
+				return flag(e.seq, "turn", "%s moved with %s to play", e.side, sideOf(rep.FEN))
+			}
+			moves[e.side]++
+			if detail := CheckClocks(tc, e.side, moves[e.side], msWhite, msBlack, p.MsWhite, p.MsBlack); detail != "" {
+				return flag(e.seq, "clock", "%s", detail)
+			}
+			msWhite, msBlack = p.MsWhite, p.MsBlack
+			rep.FEN = res.NewFEN
+
+			signed := signedMove{FEN: p.FENBefore, MsWhite: p.MsWhite, MsBlack: p.MsBlack}
+			if p.Signed != nil {
+				signed = *p.Signed
+			}
+			canonical = MoveCanonical(e.seq, p.UCI, signed.FEN, signed.MsWhite, signed.MsBlack)
+		case "resign", "draw_offer", "draw_accept":
+			var p struct {
+				FEN string `json:"fen"`
+			}
+			if err := json.Unmarshal(e.payload, &p); err != nil {
+				return flag(e.seq, "payload", "%v", err)
+			}
+			if p.FEN != rep.FEN {
+				return flag(e.seq, "position", "recorded %q, replayed %q", p.FEN, rep.FEN)
+			}
+			canonical = ControlCanonical(e.typ, e.seq, e.side)
+		default:
+			return flag(e.seq, "type", "unexpected event %q", e.typ)
+		}
+
+		if z := ComputeZobrist(rep.FEN); e.zobrist != z {
+			return flag(e.seq, "zobrist", "recorded %s, replayed %s", e.zobrist, z)
+		}
+		if e.prevHash != head {
+			return flag(e.seq, "chain", "prev hash %q does not match head %q", e.prevHash, head)
+		}
+		head = EventHash(head, e.typ, canonical, string(e.sig))
+		if e.hash != head {
+			return flag(e.seq, "chain", "recorded hash %q, recomputed %q", e.hash, head)
+		}
+		if e.sigAlg == proto.SigAlgEd25519 {
+			pub, err := playerKey(ctx, q, matchID, e.side)
+			if err != nil {
+				return nil, err
+			}
+			if pub == nil {
+				return flag(e.seq, "signature", "no public key registered for %s", e.side)
+			}
+			if CheckPlayerSig(pub, canonical, string(e.sig)) != nil {
+				return flag(e.seq, "signature", "does not match %s's public key", e.side)
+			}
+			continue
+		}
+		if e.keyGen == nil {
+			return flag(e.seq, "signature", "no key generation recorded")
+		}
+		err := matchkey.Check(ctx, q, matchID, *e.keyGen, canonical, string(e.sig))
+		switch {
+		case errors.Is(err, matchkey.ErrBadSignature):
+			return flag(e.seq, "signature", "does not match key generation %d", *e.keyGen)
+		case errors.Is(err, matchkey.ErrNoKey):
+			return flag(e.seq, "signature", "key generation %d missing", *e.keyGen)
+		case err != nil:
+			return nil, err
+		}
+	}
+
+	if lastSeq != len(events) {
+		return flag(lastSeq, "seq", "match records last_seq %d but log has %d events", lastSeq, len(events))
+	}
+	if lastFEN != rep.FEN {
+		return flag(lastSeq, "position", "match records %q, replayed %q", lastFEN, rep.FEN)
+	}
+	if len(events) > 0 && chainHead != head {
+		return flag(lastSeq, "chain", "match records head %q, replayed %q", chainHead, head)
+	}
+	return rep, nil
+}
+
+// CheckClocks reports why side's n-th move could not have taken the clocks
+// from (prevW, prevB) to (w, b) under tc, or "" if it could: the mover can
+// gain at most tc.MaxCredit(n), and the waiting side's clock must not move
+// except to take the mover's used time in hourglass.
+func CheckClocks(tc clock.TimeControl, side string, n, prevW, prevB, w, b int) string {
+	mover, prevMover, waiting, prevWaiting := w, prevW, b, prevB
+	if side == "b" {
+		mover, prevMover, waiting, prevWaiting = b, prevB, w, prevW
+	}
+	gained := waiting - prevWaiting
+	if tc.Mode != clock.ModeHourglass && gained != 0 {
+		return fmt.Sprintf("waiting clock changed from %d to %d", prevWaiting, waiting)
+	}
+	credit := tc.MaxCredit(n)
+	switch {
+	case tc.Mode == clock.ModeHourglass && gained != prevMover-mover:
+		return fmt.Sprintf("waiting clock gained %dms while mover used %dms", gained, prevMover-mover)
+	case mover > prevMover+credit:
+		return fmt.Sprintf("mover gained %dms with %dms credit", mover-prevMover, credit)
+	case mover < 0:
+		return fmt.Sprintf("mover clock negative (%d)", mover)
+	}
+	return ""
+}
+
+func sideOf(fen string) string {
+	if f := strings.Fields(fen); len(f) > 1 {
+		return f[1]
+	}
+	return ""
+}
+
+// RecordVerification stores the verdict of rep on its match so admins can
+// list suspicious games.
+func RecordVerification(ctx context.Context, q store.DBTX, rep *ReplayReport) error {
+	var reason *string
+	if rep.Issue != nil {
+		s := rep.Issue.String()
+		reason = &s
+	}
+	_, err := q.Exec(ctx, "UPDATE matches SET suspicious = $1, suspicious_reason = $2, verified_at = NOW() WHERE id = $3",
+		rep.Issue != nil, reason, rep.MatchID)
+	return err
+}
+
+// VerifyFinished replays every finished match, or only those never verified
+// when all is false, records each verdict and returns the reports.
+func VerifyFinished(ctx context.Context, s *store.Store, all bool) ([]*ReplayReport, error) {
+	rows, err := s.DB.Query(ctx, "SELECT id::text FROM matches WHERE status = 'finished' AND ($1 OR verified_at IS NULL) ORDER BY finished_at", all)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]*ReplayReport, 0, len(ids))
+	for _, id := range ids {
+		rep, err := ReplayMatch(ctx, s.DB, id)
+		if err != nil {
+			return reports, fmt.Errorf("replay %s: %w", id, err)
+		}
+		if err := RecordVerification(ctx, s.DB, rep); err != nil {
+			return reports, fmt.Errorf("record %s: %w", id, err)
+		}
+		reports = append(reports, rep)
+	}
+	return reports, nil
+}
@@ -0,0 +1,176 @@
+package referee
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"p2p-chess/internal/clock"
+	"p2p-chess/internal/store"
+)
+
+// deadlinesKey is a sorted set of live match IDs scored by the unix
+// millisecond at which the side to move flags.
+const deadlinesKey = "clock:deadlines"
+
+// watchdogPoll bounds how long the watchdog sleeps, so deadlines scheduled
+// by other instances while it waits are still caught promptly.
+const (
+	watchdogPoll  = 500 * time.Millisecond
+	watchdogBatch = 32
+)
+
+// flagDeadline is when the side to move runs out of time, if its clock is
+// running. It allows for the most lag compensation the mover can still be
+// credited, since Append would accept a move that arrives within it.
+func (m *matchState) flagDeadline() (time.Time, bool) {
+	at, ok := clock.Deadline(m.clock())
+	quota := m.QuotaWhite
+	if m.SideToMove == "b" {
+		quota = m.QuotaBlack
+	}
+	comp := min(clock.MaxLagCompMs, max(quota, 0))
+	return at.Add(time.Duration(comp) * time.Millisecond), ok
+}
+
+// RunFlagWatchdog finishes matches whose side to move has run out of time
+// without appending. It blocks until ctx is done; several instances may run
+// it, each deadline is claimed by one of them.
+func RunFlagWatchdog(ctx context.Context, s *store.Store) {
+	if err := scheduleLive(ctx, s); err != nil {
+		log.Printf("flag watchdog: schedule: %v", err)
+	}
+	for {
+		wait := watchdogPoll
+		now := time.Now()
+		due, err := s.Redis.ZRangeByScoreWithScores(ctx, deadlinesKey, &redis.ZRangeBy{
+			Min: "-inf", Max: strconv.FormatInt(now.UnixMilli(), 10), Count: watchdogBatch,
+		}).Result()
+		if err != nil {
+			log.Printf("flag watchdog: %v", err)
+		}
+		for _, z := range due {
+			matchID := z.Member.(string)
+			// ZREM is the claim: only the instance that removed it acts.
+			if n, err := s.Redis.ZRem(ctx, deadlinesKey, matchID).Result(); err != nil || n == 0 {
+				continue
+			}
+			if err := FlagFall(ctx, s, matchID); err != nil {
+				log.Printf("flag watchdog: match %s: %v", matchID, err)
+				// Put the claim back so the next pass retries it rather
+				// than leaving the match without a deadline; NX keeps a
+				// deadline an append scheduled meanwhile.
+				if err := s.Redis.ZAddNX(ctx, deadlinesKey, z).Err(); err != nil {
+					log.Printf("flag watchdog: reschedule %s: %v", matchID, err)
+				}
+			}
+		}
+		if len(due) == watchdogBatch {
+			wait = 0
+		} else if next, err := s.Redis.ZRangeWithScores(ctx, deadlinesKey, 0, 0).Result(); err == nil && len(next) > 0 {
+			if until := time.Until(time.UnixMilli(int64(next[0].Score))); until < wait {
+				wait = max(until, 0)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// FlagFall finishes matchID as a timeout if the side to move is out of time
+// by the server's clock. A deadline that has moved on is rescheduled and the
+// players are sent the server's clocks.
+func FlagFall(ctx context.Context, s *store.Store, matchID string) error {
+	tx, err := s.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	m, err := lockMatch(ctx, tx, matchID)
+	if errors.Is(err, ErrMatchOver) || errors.Is(err, ErrMatchNotFound) {
+		dropClock(ctx, s, matchID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	deadline, ok := m.flagDeadline()
+	if !ok || time.Now().Before(deadline) {
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+		// A client counting down to the old deadline shows a flag that has
+		// not fallen; give both the clocks it was rescheduled from.
+		cacheClock(ctx, s, m)
+		pushClock(ctx, s, m)
+		return nil
+	}
+
+	flagged := m.SideToMove
+	column := "ms_white"
+	if flagged == "b" {
+		column = "ms_black"
+	}
+	if _, err := tx.Exec(ctx, "UPDATE matches SET "+column+" = 0 WHERE id = $1", matchID); err != nil {
+		return err
+	}
+	result := timeoutResult(m.LastFEN, flagged)
+	if err := finishMatch(ctx, tx, matchID, result, "timeout"); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	afterFinish(ctx, s, matchID, result, "timeout")
+	return nil
+}
+
+// scheduleLive (re)schedules every match in play, covering deadlines lost
+// with the Redis copy.
+func scheduleLive(ctx context.Context, s *store.Store) error {
+	rows, err := s.DB.Query(ctx, `
+SELECT id::text, side_to_move, ms_white, ms_black, time_control, tc_base_ms, tc_inc_ms, tc_delay_ms,
+       moves_white, moves_black, tick_white_at, tick_black_at, lag_quota_white_ms, lag_quota_black_ms
+FROM matches WHERE status IN ('live', 'relayed')`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var zs []redis.Z
+	for rows.Next() {
+		m := &matchState{}
+		var tickWhite, tickBlack *time.Time
+		var tc []byte
+		var baseMs, incMs, delayMs int
+		if err := rows.Scan(&m.ID, &m.SideToMove, &m.MsWhite, &m.MsBlack, &tc, &baseMs, &incMs, &delayMs,
+			&m.MovesWhite, &m.MovesBlack, &tickWhite, &tickBlack, &m.QuotaWhite, &m.QuotaBlack); err != nil {
+			return err
+		}
+		m.TC = timeControl(tc, baseMs, incMs, delayMs)
+		if tickWhite != nil {
+			m.TickWhite = *tickWhite
+		}
+		if tickBlack != nil {
+			m.TickBlack = *tickBlack
+		}
+		if at, ok := m.flagDeadline(); ok {
+			zs = append(zs, redis.Z{Score: float64(at.UnixMilli()), Member: m.ID})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(zs) == 0 {
+		return nil
+	}
+	return s.Redis.ZAdd(ctx, deadlinesKey, zs...).Err()
+}
@@ -0,0 +1,422 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"p2p-chess/internal/store"
+)
+
+// maxPending caps how many frames are held for a seat that has not joined yet,
+// enough for an offer plus a burst of trickled ICE candidates.
+const maxPending = 64
+
+// PresenceTTL is how long a seat stays claimed by an instance without a
+// refresh; presenceRefresh must stay well below it.
+const (
+	PresenceTTL     = 30 * time.Second
+	presenceRefresh = 10 * time.Second
+	pendingTTL      = JoinTokenTTL
+)
+
+var (
+	ErrSeatTaken = errors.New("seat already joined")
+	ErrNotJoined = errors.New("not joined")
+)
+
+// Keys share a {matchID} hash tag so the scripts below stay cluster-safe.
+func presenceKey(matchID, side string) string {
+	return fmt.Sprintf("signal:{%s}:presence:%s", matchID, side)
+}
+
+func pendingKey(matchID, side string) string {
+	return fmt.Sprintf("signal:{%s}:pending:%s", matchID, side)
+}
+
+const channelPrefix = "signal:match:"
+
+func matchChannel(matchID string) string {
+	return channelPrefix + matchID
+}
+
+// busMessage is what travels over a match channel between instances.
+type busMessage struct {
+	To    string          `json:"to"`
+	Frame json.RawMessage `json:"frame"`
+}
+
+// Peer is a joined signaling connection. Frames addressed to it are written
+// to Send; the connection owns the writer side.
+type Peer struct {
+	Seat
+	Send chan<- []byte
+}
+
+type room struct {
+	peers   map[string]*Peer
+	pending map[string][][]byte
+	// joining holds, per side whose join is still talking to Redis, the
+	// frames dispatched to it meanwhile.
+	joining map[string][][]byte
+}
+
+func (rm *room) empty() bool {
+	return len(rm.peers) == 0 && len(rm.joining) == 0
+}
+
+// Hub keeps one room per match with at most one connection per side. With a
+// store it fans frames out over Redis so the two seats of a match may be
+// held by different API instances; NewHub(nil) keeps everything in-process.
+type Hub struct {
+	s        *store.Store
+	instance string
+	ps       *redis.PubSub
+
+	// mu guards rooms and is never held across a Redis call. subMu orders
+	// channel subscribes against unsubscribes of a room being dropped.
+	mu    sync.Mutex
+	subMu sync.Mutex
+	rooms map[string]*room
+}
+
+func NewHub(s *store.Store) *Hub {
+	h := &Hub{s: s, instance: instanceID(), rooms: make(map[string]*room)}
+	if s != nil {
+		h.ps = s.Redis.Subscribe(context.Background())
+		go h.dispatch()
+		go h.keepPresence()
+	}
+	return h
+}
+
+func instanceID() string {
+	if id := os.Getenv("INSTANCE_ID"); id != "" {
+		return id
+	}
+	host, _ := os.Hostname()
+	return host + "-" + uuid.Must(uuid.NewV4()).String()[:8]
+}
+
+func Opponent(side string) string {
+	if side == "w" {
+		return "b"
+	}
+	return "w"
+}
+
+// Join seats a connection in its match room and flushes anything the
+// opponent sent before it arrived.
+func (h *Hub) Join(ctx context.Context, seat Seat, send chan<- []byte) (*Peer, error) {
+	p := &Peer{Seat: seat, Send: send}
+	if h.s == nil {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		rm := h.room(seat.MatchID)
+		if _, taken := rm.peers[seat.Side]; taken {
+			return nil, ErrSeatTaken
+		}
+		rm.peers[seat.Side] = p
+		for _, frame := range rm.pending[seat.Side] {
+			deliver(p, frame)
+		}
+		delete(rm.pending, seat.Side)
+		return p, nil
+	}
+
+	// Reserve the seat locally, then subscribe and claim presence without
+	// the lock. Frames dispatched before the join completes are buffered in
+	// the reservation and delivered after the queued ones.
+	h.mu.Lock()
+	rm := h.room(seat.MatchID)
+	if _, taken := rm.peers[seat.Side]; taken {
+		h.mu.Unlock()
+		return nil, ErrSeatTaken
+	}
+	if _, busy := rm.joining[seat.Side]; busy {
+		h.mu.Unlock()
+		return nil, ErrSeatTaken
+	}
+	rm.joining[seat.Side] = [][]byte{}
+	h.mu.Unlock()
+
+	// Subscribe before claiming presence: once the claim is visible, peers
+	// publish instead of queueing and we must already be listening.
+	pending, err := h.subscribeAndClaim(ctx, seat)
+
+	h.mu.Lock()
+	buffered := rm.joining[seat.Side]
+	delete(rm.joining, seat.Side)
+	if err != nil {
+		drop := rm.empty()
+		if drop {
+			delete(h.rooms, seat.MatchID)
+		}
+		h.mu.Unlock()
+		if drop {
+			h.unsubscribe(ctx, seat.MatchID)
+		}
+		return nil, err
+	}
+	rm.peers[seat.Side] = p
+	for _, frame := range pending {
+		deliver(p, frame)
+	}
+	for _, frame := range buffered {
+		deliver(p, frame)
+	}
+	h.mu.Unlock()
+	return p, nil
+}
+
+// room returns the room of matchID, creating it. h.mu must be held.
+func (h *Hub) room(matchID string) *room {
+	rm, ok := h.rooms[matchID]
+	if !ok {
+		rm = &room{peers: make(map[string]*Peer), pending: make(map[string][][]byte), joining: make(map[string][][]byte)}
+		h.rooms[matchID] = rm
+	}
+	return rm
+}
+
+func (h *Hub) subscribeAndClaim(ctx context.Context, seat Seat) ([][]byte, error) {
+	h.subMu.Lock()
+	err := h.ps.Subscribe(ctx, matchChannel(seat.MatchID))
+	h.subMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return h.claim(ctx, seat)
+}
+
+// unsubscribe drops the channel of matchID unless a join brought its room
+// back in the meantime.
+func (h *Hub) unsubscribe(ctx context.Context, matchID string) {
+	h.subMu.Lock()
+	defer h.subMu.Unlock()
+	h.mu.Lock()
+	_, live := h.rooms[matchID]
+	h.mu.Unlock()
+	if !live {
+		_ = h.ps.Unsubscribe(ctx, matchChannel(matchID))
+	}
+}
+
+// claim takes the cross-instance presence key for seat and returns the
+// frames queued for it while nobody held it.
+func (h *Hub) claim(ctx context.Context, seat Seat) ([][]byte, error) {
+	claimed, err := h.s.Redis.SetNX(ctx, presenceKey(seat.MatchID, seat.Side), h.instance, PresenceTTL).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, ErrSeatTaken
+	}
+	frames, err := takePendingScript.Run(ctx, h.s.Redis, []string{pendingKey(seat.MatchID, seat.Side)}).StringSlice()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		_ = releaseScript.Run(ctx, h.s.Redis, []string{presenceKey(seat.MatchID, seat.Side)}, h.instance).Err()
+		return nil, err
+	}
+	pending := make([][]byte, len(frames))
+	for i, f := range frames {
+		pending[i] = []byte(f)
+	}
+	return pending, nil
+}
+
+// Leave frees the seat; the room is dropped once both sides are gone.
+func (h *Hub) Leave(ctx context.Context, p *Peer) {
+	h.mu.Lock()
+	rm, ok := h.rooms[p.MatchID]
+	if !ok || rm.peers[p.Side] != p {
+		h.mu.Unlock()
+		return
+	}
+	delete(rm.peers, p.Side)
+	drop := rm.empty()
+	if drop {
+		delete(h.rooms, p.MatchID)
+	}
+	h.mu.Unlock()
+
+	if h.s == nil {
+		return
+	}
+	if err := releaseScript.Run(ctx, h.s.Redis, []string{presenceKey(p.MatchID, p.Side)}, h.instance).Err(); err != nil && !errors.Is(err, redis.Nil) {
+		log.Printf("signaling: release presence: %v", err)
+	}
+	if drop {
+		h.unsubscribe(ctx, p.MatchID)
+	}
+}
+
+// Relay forwards frame from p to the opposite side of its match, holding it
+// until that side joins if necessary.
+func (h *Hub) Relay(ctx context.Context, p *Peer, frame []byte) error {
+	h.mu.Lock()
+	rm, ok := h.rooms[p.MatchID]
+	joined := ok && rm.peers[p.Side] == p
+	h.mu.Unlock()
+	if !joined {
+		return ErrNotJoined
+	}
+	if h.s != nil {
+		return Publish(ctx, h.s, p.MatchID, Opponent(p.Side), frame)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	to := Opponent(p.Side)
+	if peer, ok := rm.peers[to]; ok {
+		deliver(peer, frame)
+		return nil
+	}
+	if len(rm.pending[to]) < maxPending {
+		rm.pending[to] = append(rm.pending[to], frame)
+	}
+	return nil
+}
+
+// Notify sends a server-originated frame to side of matchID (both when side
+// is empty), wherever that seat is connected.
+func (h *Hub) Notify(ctx context.Context, matchID, side string, frame []byte) error {
+	if h.s != nil {
+		return Publish(ctx, h.s, matchID, side, frame)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rm, ok := h.rooms[matchID]
+	if !ok {
+		return nil
+	}
+	for _, p := range rm.peers {
+		if side == "" || p.Side == side {
+			deliver(p, frame)
+		}
+	}
+	return nil
+}
+
+// relayScript publishes to the match channel when the target seat is
+// connected somewhere and otherwise queues the frame for its next join.
+var relayScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+  redis.call('PUBLISH', ARGV[1], ARGV[2])
+  return 1
+end
+redis.call('RPUSH', KEYS[2], ARGV[3])
+redis.call('LTRIM', KEYS[2], -tonumber(ARGV[4]), -1)
+redis.call('EXPIRE', KEYS[2], ARGV[5])
+return 0
+`)
+
+var takePendingScript = redis.NewScript(`
+local frames = redis.call('LRANGE', KEYS[1], 0, -1)
+redis.call('DEL', KEYS[1])
+return frames
+`)
+
+var refreshScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Publish delivers frame to side of matchID on whichever instance holds that
+// seat. An empty side addresses both players; this is how the rest of the
+// server pushes notices to a match.
+func Publish(ctx context.Context, s *store.Store, matchID, side string, frame []byte) error {
+	sides := []string{side}
+	if side == "" {
+		sides = []string{"w", "b"}
+	}
+	for _, to := range sides {
+		msg, err := json.Marshal(busMessage{To: to, Frame: frame})
+		if err != nil {
+			return err
+		}
+		keys := []string{presenceKey(matchID, to), pendingKey(matchID, to)}
+		args := []any{matchChannel(matchID), msg, frame, maxPending, int(pendingTTL.Seconds())}
+		if err := relayScript.Run(ctx, s.Redis, keys, args...).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Presence reports which instance currently holds side of matchID.
+func Presence(ctx context.Context, s *store.Store, matchID, side string) (string, bool, error) {
+	inst, err := s.Redis.Get(ctx, presenceKey(matchID, side)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return inst, true, nil
+}
+
+func (h *Hub) dispatch() {
+	for msg := range h.ps.Channel() {
+		matchID := strings.TrimPrefix(msg.Channel, channelPrefix)
+		var bm busMessage
+		if err := json.Unmarshal([]byte(msg.Payload), &bm); err != nil {
+			continue
+		}
+		h.mu.Lock()
+		if rm, ok := h.rooms[matchID]; ok {
+			if p, ok := rm.peers[bm.To]; ok {
+				deliver(p, bm.Frame)
+			} else if buf, joining := rm.joining[bm.To]; joining && len(buf) < maxPending {
+				rm.joining[bm.To] = append(buf, bm.Frame)
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *Hub) keepPresence() {
+	ticker := time.NewTicker(presenceRefresh)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.mu.Lock()
+		var keys []string
+		for matchID, rm := range h.rooms {
+			for side := range rm.peers {
+				keys = append(keys, presenceKey(matchID, side))
+			}
+		}
+		h.mu.Unlock()
+		for _, k := range keys {
+			err := refreshScript.Run(context.Background(), h.s.Redis, []string{k}, h.instance, PresenceTTL.Milliseconds()).Err()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				log.Printf("signaling: refresh presence: %v", err)
+			}
+		}
+	}
+}
+
+// deliver never blocks the hub on a slow reader; a full buffer drops the frame.
+func deliver(p *Peer, frame []byte) {
+	select {
+	case p.Send <- frame:
+	default:
+	}
+}
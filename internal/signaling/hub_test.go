@@ -0,0 +1,46 @@
+package signaling_test
+
+import (
+	"context"
+	"p2p-chess/internal/signaling"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayReachesOpponentOnly(t *testing.T) {
+	ctx := context.Background()
+	hub := signaling.NewHub(nil)
+	outW := make(chan []byte, 4)
+	outB := make(chan []byte, 4)
+
+	white, err := hub.Join(ctx, signaling.Seat{MatchID: "m1", UserID: "u1", Side: "w"}, outW)
+	assert.NoError(t, err)
+	_, err = hub.Join(ctx, signaling.Seat{MatchID: "m1", UserID: "u2", Side: "b"}, outB)
+	assert.NoError(t, err)
+
+	assert.NoError(t, hub.Relay(ctx, white, []byte(`{"action":"offer"}`)))
+	assert.Len(t, outB, 1)
+	assert.Len(t, outW, 0)
+}
+
+func TestRelayBuffersUntilOpponentJoins(t *testing.T) {
+	ctx := context.Background()
+	hub := signaling.NewHub(nil)
+	white, _ := hub.Join(ctx, signaling.Seat{MatchID: "m1", Side: "w"}, make(chan []byte, 4))
+	assert.NoError(t, hub.Relay(ctx, white, []byte(`{"action":"offer"}`)))
+
+	outB := make(chan []byte, 4)
+	_, err := hub.Join(ctx, signaling.Seat{MatchID: "m1", Side: "b"}, outB)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"action":"offer"}`, string(<-outB))
+}
+
+func TestDuplicateJoinRejected(t *testing.T) {
+	ctx := context.Background()
+	hub := signaling.NewHub(nil)
+	_, err := hub.Join(ctx, signaling.Seat{MatchID: "m1", Side: "w"}, make(chan []byte, 1))
+	assert.NoError(t, err)
+	_, err = hub.Join(ctx, signaling.Seat{MatchID: "m1", Side: "w"}, make(chan []byte, 1))
+	assert.ErrorIs(t, err, signaling.ErrSeatTaken)
+}
@@ -0,0 +1,62 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"p2p-chess/internal/store"
+)
+
+// JoinTokenTTL bounds how long a player has to open the signaling socket
+// after being paired.
+const JoinTokenTTL = 2 * time.Hour
+
+var ErrInvalidToken = errors.New("invalid join token")
+
+// Seat identifies one player of a match as seen by the signaling server.
+type Seat struct {
+	MatchID string `json:"matchId"`
+	UserID  string `json:"userId"`
+	Side    string `json:"side"`
+}
+
+func joinKey(token string) string {
+	return "signal:join:" + token
+}
+
+// IssueJoinToken mints an opaque token that binds a signaling connection to seat.
+func IssueJoinToken(ctx context.Context, s *store.Store, seat Seat) (string, error) {
+	token := uuid.Must(uuid.NewV4()).String()
+	b, err := json.Marshal(seat)
+	if err != nil {
+		return "", err
+	}
+	if err := s.Redis.Set(ctx, joinKey(token), b, JoinTokenTTL).Err(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ResolveJoinToken returns the seat a join token was issued for.
+func ResolveJoinToken(ctx context.Context, s *store.Store, token string) (Seat, error) {
+	var seat Seat
+	if token == "" {
+		return seat, ErrInvalidToken
+	}
+	b, err := s.Redis.Get(ctx, joinKey(token)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return seat, ErrInvalidToken
+	}
+	if err != nil {
+		return seat, err
+	}
+	if err := json.Unmarshal(b, &seat); err != nil {
+		return seat, ErrInvalidToken
+	}
+	return seat, nil
+}
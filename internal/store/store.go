@@ -6,6 +6,8 @@ import (
 	"os"
 
 	glicko "github.com/gregandcin/go-glicko2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 )
@@ -15,6 +17,14 @@ type Store struct {
 	Redis *redis.Client
 }
 
+// DBTX is satisfied by both the pool and a transaction, so helpers can run
+// inside a caller's transaction or on their own.
+type DBTX interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
 func New() (*Store, error) {
 	db, err := pgxpool.New(context.Background(), os.Getenv("DB_DSN"))
 	if err != nil {
@@ -0,0 +1,4 @@
+ALTER TABLE match_events DROP COLUMN key_generation;
+ALTER TABLE matches DROP COLUMN key_grace_left;
+ALTER TABLE matches DROP COLUMN key_generation;
+DROP TABLE match_keys;
\ No newline at end of file
@@ -0,0 +1,10 @@
+CREATE TABLE match_keys (
+  match_id UUID NOT NULL REFERENCES matches(id),
+  generation INT NOT NULL,
+  sealed BYTEA NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY (match_id, generation)
+);
+ALTER TABLE matches ADD COLUMN key_generation INT NOT NULL DEFAULT 0;
+ALTER TABLE matches ADD COLUMN key_grace_left INT NOT NULL DEFAULT 0;
+ALTER TABLE match_events ADD COLUMN key_generation INT;
\ No newline at end of file
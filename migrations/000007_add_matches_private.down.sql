@@ -0,0 +1 @@
+ALTER TABLE matches DROP COLUMN private;
\ No newline at end of file
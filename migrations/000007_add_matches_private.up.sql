@@ -0,0 +1 @@
+ALTER TABLE matches ADD COLUMN private BOOL NOT NULL DEFAULT FALSE;
\ No newline at end of file
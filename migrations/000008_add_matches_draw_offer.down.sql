@@ -0,0 +1,2 @@
+ALTER TABLE matches DROP COLUMN draw_offer_seq;
+ALTER TABLE matches DROP COLUMN draw_offer_by;
\ No newline at end of file
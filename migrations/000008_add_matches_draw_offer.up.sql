@@ -0,0 +1,2 @@
+ALTER TABLE matches ADD COLUMN draw_offer_by CHAR(1) CHECK (draw_offer_by IN ('w', 'b'));
+ALTER TABLE matches ADD COLUMN draw_offer_seq INT;
\ No newline at end of file
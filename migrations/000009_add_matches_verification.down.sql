@@ -0,0 +1,3 @@
+ALTER TABLE matches DROP COLUMN verified_at;
+ALTER TABLE matches DROP COLUMN suspicious_reason;
+ALTER TABLE matches DROP COLUMN suspicious;
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE matches ADD COLUMN suspicious BOOL NOT NULL DEFAULT FALSE;
+ALTER TABLE matches ADD COLUMN suspicious_reason TEXT;
+ALTER TABLE matches ADD COLUMN verified_at TIMESTAMPTZ;
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE matches DROP COLUMN sig_offer_black, DROP COLUMN sig_offer_white, DROP COLUMN sig_alg;
+ALTER TABLE match_events DROP COLUMN sig_alg;
+DROP TABLE match_player_keys;
\ No newline at end of file
@@ -0,0 +1,11 @@
+CREATE TABLE match_player_keys (
+  match_id UUID NOT NULL REFERENCES matches(id),
+  side CHAR(1) NOT NULL CHECK (side IN ('w', 'b')),
+  pubkey BYTEA NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY (match_id, side)
+);
+ALTER TABLE match_events ADD COLUMN sig_alg TEXT NOT NULL DEFAULT 'hmac' CHECK (sig_alg IN ('hmac', 'ed25519'));
+ALTER TABLE matches ADD COLUMN sig_alg TEXT CHECK (sig_alg IN ('hmac', 'ed25519')),
+  ADD COLUMN sig_offer_white TEXT,
+  ADD COLUMN sig_offer_black TEXT;
\ No newline at end of file
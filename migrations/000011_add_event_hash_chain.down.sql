@@ -0,0 +1,3 @@
+ALTER TABLE match_events DROP COLUMN hash;
+ALTER TABLE match_events DROP COLUMN prev_hash;
+ALTER TABLE matches DROP COLUMN chain_head;
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE matches ADD COLUMN chain_head TEXT;
+ALTER TABLE match_events ADD COLUMN prev_hash TEXT;
+ALTER TABLE match_events ADD COLUMN hash TEXT;
\ No newline at end of file
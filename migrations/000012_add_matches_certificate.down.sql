@@ -0,0 +1 @@
+ALTER TABLE matches DROP COLUMN certificate;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE matches ADD COLUMN certificate TEXT;
\ No newline at end of file
@@ -0,0 +1,2 @@
+DROP TABLE match_corrections;
+DROP TABLE disputes;
\ No newline at end of file
@@ -0,0 +1,26 @@
+CREATE TABLE disputes (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  match_id UUID NOT NULL REFERENCES matches(id),
+  opened_by CHAR(1) NOT NULL CHECK (opened_by IN ('w', 'b')),
+  log_white JSONB,
+  log_black JSONB,
+  status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'resolved', 'overridden')),
+  decision TEXT,
+  reason TEXT,
+  result TEXT,
+  rewind_to INT,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  resolved_at TIMESTAMPTZ,
+  resolved_by UUID REFERENCES users(id)
+);
+CREATE INDEX disputes_match_id_idx ON disputes (match_id);
+CREATE INDEX disputes_status_created_at_idx ON disputes (status, created_at);
+CREATE TABLE match_corrections (
+  match_id UUID NOT NULL REFERENCES matches(id),
+  seq INT NOT NULL,
+  side CHAR(1) NOT NULL CHECK (side IN ('w', 'b')),
+  reason TEXT NOT NULL,
+  sig BYTEA NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL
+);
+CREATE INDEX match_corrections_match_id_idx ON match_corrections (match_id);
\ No newline at end of file
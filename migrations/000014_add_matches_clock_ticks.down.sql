@@ -0,0 +1,2 @@
+ALTER TABLE matches DROP COLUMN tick_black_at;
+ALTER TABLE matches DROP COLUMN tick_white_at;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE matches ADD COLUMN tick_white_at TIMESTAMPTZ;
+ALTER TABLE matches ADD COLUMN tick_black_at TIMESTAMPTZ;
\ No newline at end of file
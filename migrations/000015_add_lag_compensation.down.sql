@@ -0,0 +1,3 @@
+ALTER TABLE match_events DROP COLUMN lag_comp_ms;
+ALTER TABLE matches DROP COLUMN lag_quota_black_ms;
+ALTER TABLE matches DROP COLUMN lag_quota_white_ms;
\ No newline at end of file
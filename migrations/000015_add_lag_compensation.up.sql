@@ -0,0 +1,3 @@
+ALTER TABLE matches ADD COLUMN lag_quota_white_ms INT NOT NULL DEFAULT 1500;
+ALTER TABLE matches ADD COLUMN lag_quota_black_ms INT NOT NULL DEFAULT 1500;
+ALTER TABLE match_events ADD COLUMN lag_comp_ms INT NOT NULL DEFAULT 0;
\ No newline at end of file
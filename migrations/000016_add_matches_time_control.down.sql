@@ -0,0 +1,3 @@
+ALTER TABLE matches DROP COLUMN moves_black;
+ALTER TABLE matches DROP COLUMN moves_white;
+ALTER TABLE matches DROP COLUMN time_control;
\ No newline at end of file
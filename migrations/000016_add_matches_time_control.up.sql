@@ -0,0 +1,3 @@
+ALTER TABLE matches ADD COLUMN time_control JSONB;
+ALTER TABLE matches ADD COLUMN moves_white INT NOT NULL DEFAULT 0;
+ALTER TABLE matches ADD COLUMN moves_black INT NOT NULL DEFAULT 0;
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE user_blocks;
\ No newline at end of file
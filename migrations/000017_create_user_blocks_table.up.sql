@@ -0,0 +1,8 @@
+CREATE TABLE user_blocks (
+  blocker_id UUID NOT NULL REFERENCES users(id),
+  blocked_id UUID NOT NULL REFERENCES users(id),
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  PRIMARY KEY (blocker_id, blocked_id),
+  CHECK (blocker_id <> blocked_id)
+);
+CREATE INDEX user_blocks_blocked_id_idx ON user_blocks (blocked_id);
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE matches DROP COLUMN start_fen;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE matches ADD COLUMN start_fen TEXT;
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE challenges;
\ No newline at end of file
@@ -0,0 +1,19 @@
+CREATE TABLE challenges (
+  id UUID PRIMARY KEY,
+  challenger_id UUID NOT NULL REFERENCES users(id),
+  challenged_id UUID REFERENCES users(id),
+  tc TEXT NOT NULL,
+  time_control JSONB NOT NULL,
+  color TEXT NOT NULL DEFAULT 'random' CHECK (color IN ('white', 'black', 'random')),
+  rated BOOLEAN NOT NULL DEFAULT FALSE,
+  start_fen TEXT,
+  min_rating INT,
+  max_rating INT,
+  status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'accepted', 'declined', 'cancelled', 'expired')),
+  match_id UUID REFERENCES matches(id),
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL,
+  CHECK (challenger_id <> challenged_id)
+);
+CREATE INDEX challenges_challenged_id_idx ON challenges (challenged_id) WHERE status = 'open';
+CREATE INDEX challenges_open_seeks_idx ON challenges (created_at) WHERE status = 'open' AND challenged_id IS NULL;
\ No newline at end of file
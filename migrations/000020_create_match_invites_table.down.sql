@@ -0,0 +1,4 @@
+DROP TABLE match_invites;
+DELETE FROM matches WHERE side_white IS NULL OR side_black IS NULL;
+ALTER TABLE matches ALTER COLUMN side_white SET NOT NULL;
+ALTER TABLE matches ALTER COLUMN side_black SET NOT NULL;
\ No newline at end of file
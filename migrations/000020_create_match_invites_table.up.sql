@@ -0,0 +1,13 @@
+ALTER TABLE matches ALTER COLUMN side_white DROP NOT NULL;
+ALTER TABLE matches ALTER COLUMN side_black DROP NOT NULL;
+CREATE TABLE match_invites (
+  code TEXT PRIMARY KEY,
+  match_id UUID NOT NULL UNIQUE REFERENCES matches(id),
+  created_by UUID NOT NULL REFERENCES users(id),
+  created_at TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL,
+  revoked_at TIMESTAMPTZ,
+  used_by UUID REFERENCES users(id),
+  used_at TIMESTAMPTZ
+);
+CREATE INDEX match_invites_created_by_idx ON match_invites (created_by);
\ No newline at end of file
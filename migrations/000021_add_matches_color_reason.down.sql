@@ -0,0 +1 @@
+ALTER TABLE matches DROP COLUMN color_reason;
\ No newline at end of file
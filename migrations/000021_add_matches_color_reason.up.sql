@@ -0,0 +1 @@
+ALTER TABLE matches ADD COLUMN color_reason TEXT;
\ No newline at end of file